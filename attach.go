@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type attachAddCmd struct {
+	name string
+	as   string
+}
+
+func (c *attachAddCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "add <file>",
+		Args: cobra.ExactArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *attachAddCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.name, "name", "", "")
+	cobra.MarkFlagRequired(fs, "name")
+	fs.StringVar(&c.as, "as", "", "name of the attachment, defaults to the base name of the file")
+}
+
+func (c *attachAddCmd) run(cmd *cobra.Command, args []string) {
+	f, err := os.Open(args[0])
+	if err != nil {
+		cmd.PrintErrf("failed to open %q: %v", args[0], err)
+		return
+	}
+	defer f.Close()
+	file := c.as
+	if file == "" {
+		file = filepath.Base(args[0])
+	}
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	err = db.Update(func(tx *pwdb.Tx) error {
+		return tx.Attach(c.name, file, f)
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to attach %q: %v", args[0], err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type attachGetCmd struct {
+	name  string
+	out   string
+	force bool
+}
+
+func (c *attachGetCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "get <attachment>",
+		Args: cobra.ExactArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *attachGetCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.name, "name", "", "")
+	cobra.MarkFlagRequired(fs, "name")
+	fs.StringVarP(&c.out, "out", "o", "", "file to write, defaults to the name of the attachment; - for stdout")
+	fs.BoolVar(&c.force, "force", false, "overwrite an existing file")
+}
+
+func (c *attachGetCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(readOnly())
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	out := c.out
+	if out == "" {
+		out = filepath.Base(args[0])
+	}
+	if out == "-" {
+		if err := db.ReadAttachment(c.name, args[0], os.Stdout); err != nil {
+			cmd.PrintErrf("failed to read attachment %q: %v", args[0], err)
+		}
+		return
+	}
+	if _, err := os.Lstat(out); err == nil && !c.force {
+		cmd.PrintErrf("%q already exists, use --force to overwrite it", out)
+		return
+	}
+	// Write to a temporary file first so that a damaged attachment does not
+	// leave a partial file behind.
+	tmp := out + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		cmd.PrintErrf("failed to create %q: %v", tmp, err)
+		return
+	}
+	err = db.ReadAttachment(c.name, args[0], f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, out)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		cmd.PrintErrf("failed to read attachment %q: %v", args[0], err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type attachRmCmd struct {
+	name string
+}
+
+func (c *attachRmCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "rm <attachment>...",
+		Args: cobra.MinimumNArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *attachRmCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.name, "name", "", "")
+	cobra.MarkFlagRequired(fs, "name")
+}
+
+func (c *attachRmCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	err = db.Update(func(tx *pwdb.Tx) error {
+		for _, file := range args {
+			if err := tx.Detach(c.name, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to remove attachments: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type backupListCmd struct {
+}
+
+func (c *backupListCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "list",
+		Run: c.run,
+	}
+}
+
+func (c *backupListCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *backupListCmd) run(cmd *cobra.Command, args []string) {
+	backups, err := pwdb.ListBackups(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to list backups: %v", err)
+		return
+	}
+	for _, b := range backups {
+		cmd.Printf("%s\t%s\n", b.ID, formatTime(b.Time))
+	}
+}
+
+type restoreCmd struct {
+}
+
+func (c *restoreCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <id>",
+		Short: "Replaces the records of the vault with one of its backups.",
+		Long:  "Replaces the records of the vault with one of its backups. Backups do not keep keys: they are unlocked with the current slots of the vault, and are removed by rekey and encrypt-names.",
+		Args:  cobra.ExactArgs(1),
+		Run:   c.run,
+	}
+}
+
+func (c *restoreCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *restoreCmd) run(cmd *cobra.Command, args []string) {
+	if err := pwdb.RestoreBackup(opts, args[0]); err != nil {
+		cmd.PrintErrf("failed to restore backup: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type compactCmd struct {
+}
+
+func (c *compactCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "compact",
+		Short: "Rewrites the log of changes into a new snapshot.",
+		Run:   c.run,
+	}
+}
+
+func (c *compactCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *compactCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if err := db.Compact(); err != nil {
+		cmd.PrintErrf("failed to compact pwdb: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type treeCmd struct {
+}
+
+func (c *treeCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "tree [folder]",
+		Args: cobra.MaximumNArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *treeCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *treeCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(readOnly())
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	var folder string
+	if len(args) > 0 {
+		folder = args[0]
+	}
+	var prev []string
+	for _, name := range db.List(folder) {
+		parts := strings.Split(name, pwdb.Separator)
+		dirs := parts[:len(parts)-1]
+		// Skip the folders that were already printed for the previous record.
+		i := 0
+		for i < len(dirs) && i < len(prev) && dirs[i] == prev[i] {
+			i++
+		}
+		for ; i < len(dirs); i++ {
+			cmd.Printf("%s%s%s\n", strings.Repeat("  ", i), dirs[i], pwdb.Separator)
+		}
+		cmd.Printf("%s%s\n", strings.Repeat("  ", len(dirs)), parts[len(parts)-1])
+		prev = dirs
+	}
+}
+
+type exportCmd struct {
+	concurrency int
+}
+
+func (c *exportCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "export [folder]",
+		Args: cobra.MaximumNArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *exportCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&c.concurrency, "concurrency", 0, "number of records to decrypt at once, defaults to the number of CPUs")
+}
+
+func (c *exportCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(readOnly())
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	var folder string
+	if len(args) > 0 {
+		folder = args[0]
+	}
+	var out pwdb.Export
+	err = db.ForEach(folder, c.concurrency, func(name string, r *pwdb.Record) error {
+		out.Records = append(out.Records, &pwdb.NamedRecord{
+			Name:   name,
+			Record: r,
+		})
+		return nil
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to export records: %v", err)
+		return
+	}
+	fmt.Print(proto.MarshalTextString(&out))
+}
+
+type importCmd struct {
+	file string
+}
+
+func (c *importCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "import",
+		Run: c.run,
+	}
+}
+
+func (c *importCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.file, "file", "", "")
+	cobra.MarkFlagRequired(fs, "file")
+}
+
+func (c *importCmd) run(cmd *cobra.Command, args []string) {
+	b, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		cmd.PrintErrf("failed to read %q: %v", c.file, err)
+		return
+	}
+	var in pwdb.Export
+	if err := proto.UnmarshalText(string(b), &in); err != nil {
+		cmd.PrintErrf("failed to parse %q: %v", c.file, err)
+		return
+	}
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	err = db.Update(func(tx *pwdb.Tx) error {
+		for _, nr := range in.Records {
+			if nr.Record == nil {
+				return fmt.Errorf("%q has no record", nr.Name)
+			}
+			if err := tx.Put(nr.Name, nr.Record); err != nil {
+				return fmt.Errorf("%q: %v", nr.Name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to import records: %v", err)
+		return
+	}
+	cmd.Printf("imported %d records\n", len(in.Records))
+}
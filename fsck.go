@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type fsckCmd struct {
+	salvage string
+}
+
+func (c *fsckCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "fsck",
+		Short: "Checks the vault for damage.",
+		Run:   c.run,
+	}
+}
+
+func (c *fsckCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.salvage, "salvage", "", "copy every readable record into a new vault with this name")
+}
+
+func (c *fsckCmd) run(cmd *cobra.Command, args []string) {
+	if c.salvage != "" {
+		n, err := pwdb.Salvage(opts, c.salvage)
+		if err != nil {
+			cmd.PrintErrf("failed to salvage pwdb: %v", err)
+			return
+		}
+		cmd.Printf("salvaged %d records into vault %q\n", n, c.salvage)
+		return
+	}
+	r, err := pwdb.Fsck(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to check pwdb: %v", err)
+		return
+	}
+	for _, p := range r.Problems {
+		cmd.Println(p)
+	}
+	if len(r.Problems) > 0 {
+		cmd.Printf("checked %d records, found %d problems\n", r.Records, len(r.Problems))
+		return
+	}
+	cmd.Printf("checked %d records, ok\n", r.Records)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type historyCmd struct {
+	name string
+}
+
+func (c *historyCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "history",
+		Run: c.run,
+	}
+}
+
+func (c *historyCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.name, "name", "", "")
+	cobra.MarkFlagRequired(fs, "name")
+}
+
+func (c *historyCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(readOnly())
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	times, err := db.History(c.name)
+	if err != nil {
+		cmd.PrintErrf("failed to get history of %q: %v", c.name, err)
+		return
+	}
+	for i, t := range times {
+		cmd.Printf("%d\t%s\n", i, formatTime(t))
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+type rollbackCmd struct {
+	name string
+	to   int
+}
+
+func (c *rollbackCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "rollback",
+		Run: c.run,
+	}
+}
+
+func (c *rollbackCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.name, "name", "", "")
+	cobra.MarkFlagRequired(fs, "name")
+	fs.IntVar(&c.to, "to", 0, "")
+	cobra.MarkFlagRequired(fs, "to")
+}
+
+func (c *rollbackCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if err := db.Rollback(c.name, c.to); err != nil {
+		cmd.PrintErrf("failed to roll back %q: %v", c.name, err)
+		return
+	}
+	cmd.Println("ok")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type identityCreateCmd struct {
+}
+
+func (c *identityCreateCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "create <path>",
+		Short: "Writes a new identity file and prints its public key, for slots add --type public-key.",
+		Args:  cobra.ExactArgs(1),
+		Run:   c.run,
+	}
+}
+
+func (c *identityCreateCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *identityCreateCmd) run(cmd *cobra.Command, args []string) {
+	pub, err := pwdb.CreateIdentity(args[0])
+	if err != nil {
+		cmd.PrintErrf("failed to create identity: %v", err)
+		return
+	}
+	cmd.Printf("public key: %s\n", pub)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mikedanese/pwstore/passwd"
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type kdfTuneCmd struct {
+	target  time.Duration
+	memory  uint32
+	threads uint8
+}
+
+func (c *kdfTuneCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "tune",
+		Short: "Benchmarks this machine and suggests KDF parameters for kdf set.",
+		Args:  cobra.NoArgs,
+		Run:   c.run,
+	}
+}
+
+func (c *kdfTuneCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&c.target, "target", time.Second, "time to derive a key in")
+	fs.Uint32Var(&c.memory, "memory", passwd.DefaultKDFParams.Memory/1024, "most memory to use, in MiB")
+	fs.Uint8Var(&c.threads, "threads", passwd.DefaultKDFParams.Threads, "")
+}
+
+func (c *kdfTuneCmd) run(cmd *cobra.Command, args []string) {
+	if c.target <= 0 {
+		cmd.PrintErrf("target must be positive")
+		return
+	}
+	if c.memory > passwd.MaxKDFMemory/1024 {
+		cmd.PrintErrf("invalid parameters: memory must be at most %dMiB", passwd.MaxKDFMemory/1024)
+		return
+	}
+	max := passwd.KDFParams{Time: 1, Memory: c.memory * 1024, Threads: c.threads}
+	if err := max.Validate(); err != nil {
+		cmd.PrintErrf("invalid parameters: %v", err)
+		return
+	}
+	if slots, err := pwdb.Slots(opts); err == nil {
+		for _, s := range slots {
+			if cur, err := s.KDFParams(); err == nil {
+				cmd.Printf("slot %d:    %s\n", s.Id, formatKDF(cur))
+			}
+		}
+	}
+	p, took := passwd.Tune(c.target, max.Memory, max.Threads)
+	cmd.Printf("suggested: %s, took %v\n", formatKDF(p), took.Round(time.Millisecond))
+	cmd.Printf("apply with: pwstore kdf set --time %d --memory %d --threads %d\n", p.Time, p.Memory/1024, p.Threads)
+}
+
+func formatKDF(p passwd.KDFParams) string {
+	return fmt.Sprintf("argon2id time=%d memory=%dMiB threads=%d", p.Time, p.Memory/1024, p.Threads)
+}
+
+type kdfSetCmd struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (c *kdfSetCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set",
+		Short: "Re-wraps the vault key in the slot that unlocks it with new KDF parameters.",
+		Args:  cobra.NoArgs,
+		Run:   c.run,
+	}
+}
+
+func (c *kdfSetCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.Uint32Var(&c.time, "time", 0, "number of passes, defaults to the current value")
+	fs.Uint32Var(&c.memory, "memory", 0, "memory in MiB, defaults to the current value")
+	fs.Uint8Var(&c.threads, "threads", 0, "defaults to the current value")
+}
+
+func (c *kdfSetCmd) run(cmd *cobra.Command, args []string) {
+	if c.memory > passwd.MaxKDFMemory/1024 {
+		cmd.PrintErrf("failed to set kdf parameters: memory must be at most %dMiB", passwd.MaxKDFMemory/1024)
+		return
+	}
+	p := passwd.KDFParams{Time: c.time, Memory: c.memory * 1024, Threads: c.threads}
+	if err := pwdb.SetKDF(opts, p); err != nil {
+		cmd.PrintErrf("failed to set kdf parameters: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
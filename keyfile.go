@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type keyfileCreateCmd struct {
+}
+
+func (c *keyfileCreateCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "create <path>",
+		Short: "Writes a new keyfile of random bytes.",
+		Args:  cobra.ExactArgs(1),
+		Run:   c.run,
+	}
+}
+
+func (c *keyfileCreateCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *keyfileCreateCmd) run(cmd *cobra.Command, args []string) {
+	if err := pwdb.CreateKeyfile(args[0]); err != nil {
+		cmd.PrintErrf("failed to create keyfile: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type keyfileAddCmd struct {
+}
+
+func (c *keyfileAddCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "add <path>",
+		Short: "Makes the vault need the keyfile at path as well as the password.",
+		Args:  cobra.ExactArgs(1),
+		Run:   c.run,
+	}
+}
+
+func (c *keyfileAddCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *keyfileAddCmd) run(cmd *cobra.Command, args []string) {
+	if err := pwdb.SetKeyfile(opts, args[0]); err != nil {
+		cmd.PrintErrf("failed to add keyfile: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type keyfileRmCmd struct {
+}
+
+func (c *keyfileRmCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rm",
+		Short: "Makes the vault need only the password.",
+		Args:  cobra.NoArgs,
+		Run:   c.run,
+	}
+}
+
+func (c *keyfileRmCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *keyfileRmCmd) run(cmd *cobra.Command, args []string) {
+	if err := pwdb.SetKeyfile(opts, ""); err != nil {
+		cmd.PrintErrf("failed to remove keyfile: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
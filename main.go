@@ -10,15 +10,22 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"sort"
+	"strings"
+	"time"
 	"unicode/utf8"
 
-	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/google/tink/go/subtle/random"
 	"github.com/mikedanese/pwstore/pwdb"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
 
+// opts selects the vault that every command operates on.
+var opts pwdb.Options
+
 func main() {
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
@@ -26,9 +33,37 @@ func main() {
 
 	root := &cobra.Command{
 		Use: "pwstore",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			opts.Command = strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+		},
 	}
+	root.PersistentFlags().StringVar(&opts.Dir, "dir", "", "")
+	root.PersistentFlags().StringVar(&opts.Vault, "vault", "", "")
+	root.PersistentFlags().StringVar(&opts.StateDir, "state-dir", "", "directory of per-user state kept outside of the vaults, defaults to $PWSTORE_STATE_DIR or ~/.local/state/pwstore")
+	root.PersistentFlags().DurationVar(&opts.LockTimeout, "lock-timeout", 10*time.Second, "")
+	root.PersistentFlags().BoolVar(&opts.ForceAcceptRollback, "force-accept-rollback", false, "")
+	root.PersistentFlags().IntVar(&opts.Backups, "backups", pwdb.DefaultBackups, "")
+	root.PersistentFlags().StringVar(&opts.Keyfile, "keyfile", "", "keyfile of a vault that needs one, defaults to $PWSTORE_KEYFILE or the path recorded by keyfile add")
+	root.PersistentFlags().StringVar(&opts.Identity, "identity", "", "identity file that opens a public key slot, defaults to $PWSTORE_IDENTITY")
 	addSub(root, &copyCmd{})
 	addSub(root, &genCmd{})
+	addSub(root, &historyCmd{})
+	addSub(root, &rollbackCmd{})
+	addSub(root, &rmCmd{})
+	addSub(root, &mvCmd{})
+	addSub(root, &cpCmd{})
+	addSub(root, &listCmd{})
+	addSub(root, &treeCmd{})
+	addSub(root, &exportCmd{})
+	addSub(root, &importCmd{})
+	addSub(root, &compactCmd{})
+	addSub(root, &migrateCmd{})
+	addSub(root, &encryptNamesCmd{})
+	addSub(root, &restoreCmd{})
+	addSub(root, &fsckCmd{})
+	addSub(root, &searchCmd{})
+	addSub(root, &passwdCmd{})
+	addSub(root, &rekeyCmd{})
 
 	raw := &cobra.Command{
 		Use:   "raw",
@@ -36,6 +71,54 @@ func main() {
 	}
 	root.AddCommand(raw)
 
+	vault := &cobra.Command{
+		Use:   "vault",
+		Short: "Manage vaults.",
+	}
+	root.AddCommand(vault)
+
+	trash := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage deleted records.",
+	}
+	root.AddCommand(trash)
+
+	backup := &cobra.Command{
+		Use:   "backup",
+		Short: "Manage vault backups.",
+	}
+	root.AddCommand(backup)
+
+	attach := &cobra.Command{
+		Use:   "attach",
+		Short: "Manage files attached to records.",
+	}
+	root.AddCommand(attach)
+
+	kdf := &cobra.Command{
+		Use:   "kdf",
+		Short: "Manage the parameters of the key derivation from the password.",
+	}
+	root.AddCommand(kdf)
+
+	keyfile := &cobra.Command{
+		Use:   "keyfile",
+		Short: "Manage the keyfile that unlocks the vault with the password.",
+	}
+	root.AddCommand(keyfile)
+
+	slots := &cobra.Command{
+		Use:   "slots",
+		Short: "Manage the key slots that unlock the vault.",
+	}
+	root.AddCommand(slots)
+
+	identity := &cobra.Command{
+		Use:   "identity",
+		Short: "Manage identity files that open public key slots.",
+	}
+	root.AddCommand(identity)
+
 	completion := &cobra.Command{
 		Use:   "completion",
 		Short: "Generates bash completion scripts",
@@ -49,12 +132,47 @@ func main() {
 	addSub(raw, &listCmd{})
 	addSub(raw, &putCmd{})
 
+	addSub(vault, &vaultListCmd{})
+	addSub(vault, &vaultUseCmd{})
+	addSub(vault, &vaultCreateCmd{})
+
+	addSub(trash, &trashListCmd{})
+	addSub(trash, &trashRestoreCmd{})
+	addSub(trash, &trashEmptyCmd{})
+	addSub(trash, &trashRetentionCmd{})
+
+	addSub(backup, &backupListCmd{})
+
+	addSub(attach, &attachAddCmd{})
+	addSub(attach, &attachGetCmd{})
+	addSub(attach, &attachRmCmd{})
+
+	addSub(kdf, &kdfTuneCmd{})
+	addSub(kdf, &kdfSetCmd{})
+
+	addSub(keyfile, &keyfileCreateCmd{})
+	addSub(keyfile, &keyfileAddCmd{})
+	addSub(keyfile, &keyfileRmCmd{})
+
+	addSub(slots, &slotsListCmd{})
+	addSub(slots, &slotsAddCmd{})
+	addSub(slots, &slotsRemoveCmd{})
+
+	addSub(identity, &identityCreateCmd{})
+
 	if err := root.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// readOnly returns opts for commands that do not modify the vault.
+func readOnly() pwdb.Options {
+	o := opts
+	o.ReadOnly = true
+	return o
+}
+
 type cmd interface {
 	cmd() *cobra.Command
 	bindFlags(fs *pflag.FlagSet)
@@ -68,7 +186,9 @@ func addSub(root *cobra.Command, sub cmd) *cobra.Command {
 }
 
 type getCmd struct {
-	name string
+	name     string
+	revision int
+	reveal   bool
 }
 
 func (c *getCmd) cmd() *cobra.Command {
@@ -81,46 +201,132 @@ func (c *getCmd) cmd() *cobra.Command {
 func (c *getCmd) bindFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&c.name, "name", "", "")
 	cobra.MarkFlagRequired(fs, "name")
+	fs.IntVarP(&c.revision, "revision", "r", 0, "")
+	fs.BoolVar(&c.reveal, "reveal", false, "show the values of hidden fields")
 }
 
 func (c *getCmd) run(cmd *cobra.Command, args []string) {
-	db, err := pwdb.Open()
+	db, err := pwdb.Open(readOnly())
 	if err != nil {
 		cmd.PrintErrf("failed to open pwdb: %v", err)
 		return
 	}
-	r, err := db.Get(c.name)
+	r, err := db.GetRevision(c.name, c.revision)
 	if err != nil {
 		cmd.PrintErrf("failed to get %q: %v", c.name, err)
 		return
 	}
+	if !c.reveal {
+		r = pwdb.Redact(r)
+	}
 	fmt.Print(proto.MarshalTextString(r))
 }
 
 type listCmd struct {
+	long bool
+	sort string
+	kind string
 }
 
 func (c *listCmd) cmd() *cobra.Command {
 	return &cobra.Command{
-		Use: "list",
-		Run: c.run,
+		Use:  "list [folder]",
+		Args: cobra.MaximumNArgs(1),
+		Run:  c.run,
 	}
 }
 
 func (c *listCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.BoolVarP(&c.long, "long", "l", false, "")
+	fs.StringVar(&c.sort, "sort", "name", "name, created or updated")
+	fs.StringVar(&c.kind, "type", "", "only list records of this kind: "+strings.Join(pwdb.Kinds, ", "))
 }
 
 func (c *listCmd) run(cmd *cobra.Command, args []string) {
-	db, err := pwdb.Open()
+	db, err := pwdb.Open(readOnly())
 	if err != nil {
 		cmd.PrintErrf("failed to open pwdb: %v", err)
 		return
 	}
-	for _, name := range db.List() {
-		cmd.Println(name)
+	var folder string
+	if len(args) > 0 {
+		folder = args[0]
+	}
+	if c.kind != "" && !validKind(c.kind) {
+		cmd.PrintErrf("unknown record type %q, want one of %s", c.kind, strings.Join(pwdb.Kinds, ", "))
+		return
+	}
+	names := db.List(folder)
+	if !c.long && c.sort == "name" && c.kind == "" {
+		for _, name := range names {
+			cmd.Println(name)
+		}
+		return
+	}
+	type entry struct {
+		name                   string
+		createTime, updateTime time.Time
+		kind, summary          string
+	}
+	var entries []entry
+	now := time.Now()
+	for _, name := range names {
+		m, err := db.Metadata(name)
+		if err != nil {
+			cmd.PrintErrf("failed to get %q: %v", name, err)
+			return
+		}
+		if c.kind != "" && m.Kind != c.kind {
+			continue
+		}
+		e := entry{name: name, kind: m.Kind, summary: m.Summary}
+		if pwdb.Expired(m, now) {
+			e.summary += " (expired)"
+		}
+		if m.CreateTime != nil {
+			e.createTime, _ = ptypes.Timestamp(m.CreateTime)
+		}
+		if m.UpdateTime != nil {
+			e.updateTime, _ = ptypes.Timestamp(m.UpdateTime)
+		} else if times, err := db.History(name); err == nil {
+			// Records written before Put set update_time still have
+			// the time their envelope was written.
+			e.updateTime = times[0]
+		}
+		entries = append(entries, e)
+	}
+	switch c.sort {
+	case "name":
+	case "created":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].createTime.Before(entries[j].createTime)
+		})
+	case "updated":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].updateTime.Before(entries[j].updateTime)
+		})
+	default:
+		cmd.PrintErrf("unknown sort order %q", c.sort)
+		return
+	}
+	for _, e := range entries {
+		if c.long {
+			cmd.Printf("%s\t%s\t%s\t%s\t%s\n", formatTime(e.createTime), formatTime(e.updateTime), e.kind, e.name, e.summary)
+		} else {
+			cmd.Println(e.name)
+		}
 	}
 }
 
+func validKind(kind string) bool {
+	for _, k := range pwdb.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
 type putCmd struct {
 	name string
 	file string
@@ -141,7 +347,7 @@ func (c *putCmd) bindFlags(fs *pflag.FlagSet) {
 }
 
 func (c *putCmd) run(cmd *cobra.Command, args []string) {
-	db, err := pwdb.Open()
+	db, err := pwdb.Open(opts)
 	if err != nil {
 		cmd.PrintErrf("failed to open pwdb: %v", err)
 		return
@@ -166,6 +372,7 @@ func (c *putCmd) run(cmd *cobra.Command, args []string) {
 type copyCmd struct {
 	name     string
 	username bool
+	field    string
 }
 
 func (c *copyCmd) cmd() *cobra.Command {
@@ -179,10 +386,11 @@ func (c *copyCmd) bindFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&c.name, "name", "", "")
 	cobra.MarkFlagRequired(fs, "name")
 	fs.BoolVarP(&c.username, "username", "u", false, "")
+	fs.StringVarP(&c.field, "field", "f", "", "name of a custom field to copy")
 }
 
 func (c *copyCmd) run(cmd *cobra.Command, args []string) {
-	db, err := pwdb.Open()
+	db, err := pwdb.Open(readOnly())
 	if err != nil {
 		cmd.PrintErrf("failed to open pwdb: %v", err)
 		return
@@ -196,6 +404,14 @@ func (c *copyCmd) run(cmd *cobra.Command, args []string) {
 	if c.username {
 		out = r.Username
 	}
+	if c.field != "" {
+		v, ok := pwdb.Lookup(r, c.field)
+		if !ok {
+			cmd.PrintErrf("failed to copy %q: no field %q", c.name, c.field)
+			return
+		}
+		out = v
+	}
 	ansiCopy(cmd.OutOrStdout(), out)
 	cmd.Println("ok")
 }
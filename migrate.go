@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type migrateCmd struct {
+}
+
+func (c *migrateCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrades a vault to the current on-disk format.",
+		Run:   c.run,
+	}
+}
+
+func (c *migrateCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *migrateCmd) run(cmd *cobra.Command, args []string) {
+	backup, err := pwdb.Migrate(opts)
+	if backup != "" {
+		cmd.Printf("backed up vault to %s\n", backup)
+	}
+	if err != nil {
+		cmd.PrintErrf("failed to migrate pwdb: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
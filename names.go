@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type encryptNamesCmd struct {
+}
+
+func (c *encryptNamesCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "encrypt-names",
+		Short: "Encrypts the names of all records in the vault.",
+		Run:   c.run,
+	}
+}
+
+func (c *encryptNamesCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *encryptNamesCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if err := db.EncryptNames(); err != nil {
+		cmd.PrintErrf("failed to encrypt names: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
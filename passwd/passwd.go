@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/google/tink/go/subtle/aead"
 	"github.com/google/tink/go/subtle/random"
@@ -40,9 +41,9 @@ func setSecretInputTermMode(fd uintptr) (func(), error) {
 	}, nil
 }
 
-func readPasswordFromUser(in io.Reader, out io.Writer) []byte {
+func readPasswordFromUser(in io.Reader, out io.Writer, label string) []byte {
 	var b bytes.Buffer
-	prompt := &pwPrompt{o: bufio.NewWriter(out), rr: &runeReader{r: in}}
+	prompt := &pwPrompt{o: bufio.NewWriter(out), rr: &runeReader{r: in}, label: label}
 
 	prompt.writePasswordPrompt()
 
@@ -72,9 +73,10 @@ Read:
 }
 
 type pwPrompt struct {
-	read int
-	rr   *runeReader
-	o    *bufio.Writer
+	read  int
+	rr    *runeReader
+	o     *bufio.Writer
+	label string
 }
 
 func (pw *pwPrompt) ReadRune() (rune, error) {
@@ -108,7 +110,7 @@ func (pw *pwPrompt) writePasswordPrompt() {
 	if _, err := pw.o.WriteRune('\r'); err != nil {
 		panic(err)
 	}
-	if _, err := pw.o.WriteString("Enter Password: "); err != nil {
+	if _, err := pw.o.WriteString(pw.label); err != nil {
 		panic(err)
 	}
 	for i := 0; i < length; i++ {
@@ -134,30 +136,117 @@ func (rr *runeReader) ReadRune() (rune, error) {
 	return rune(rr.buf[0]), nil
 }
 
-func Read(salt []byte) (tink.AEAD, error) {
-	if len(salt) < 16 {
-		panic(fmt.Sprintf("salt is too small: %d", salt))
+// KDFParams are the argon2id parameters used to derive a key from a
+// password.
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+}
+
+// DefaultKDFParams are the parameters that every vault used before they were
+// configurable.
+var DefaultKDFParams = KDFParams{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// MaxKDFMemory is the most memory, in KiB, that Validate accepts, so that a
+// damaged slot cannot make DeriveKey exhaust memory.
+const MaxKDFMemory = 4 << 20
+
+// Validate checks that argon2id accepts p.
+func (p KDFParams) Validate() error {
+	if p.Time < 1 {
+		return fmt.Errorf("kdf time must be at least 1")
+	}
+	if p.Threads < 1 {
+		return fmt.Errorf("kdf threads must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("kdf memory must be at least 8KiB per thread")
+	}
+	if p.Memory > MaxKDFMemory {
+		return fmt.Errorf("kdf memory must be at most %dMiB", MaxKDFMemory/1024)
+	}
+	return nil
+}
+
+// minTuneMemory is the least memory, in KiB, that Tune picks.
+const minTuneMemory = 8 * 1024
+
+// Tune returns parameters with which deriving a key takes about target on
+// this machine, and how long it took with them. It uses threads lanes and
+// maxMemory KiB, or less if a single pass over that much memory takes longer
+// than target, and as many passes as fit in target.
+func Tune(target time.Duration, maxMemory uint32, threads uint8) (KDFParams, time.Duration) {
+	salt := random.GetRandomBytes(16)
+	measure := func(p KDFParams) time.Duration {
+		start := time.Now()
+		argon2.IDKey([]byte("pwstore"), salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+		return time.Since(start)
+	}
+	p := KDFParams{Time: 1, Memory: maxMemory, Threads: threads}
+	d := measure(p)
+	for d > target && p.Memory/2 >= minTuneMemory && p.Memory/2 >= 8*uint32(threads) {
+		p.Memory /= 2
+		d = measure(p)
+	}
+	if n := uint32(target / d); n > 1 {
+		p.Time = n
+		d = measure(p)
+	}
+	return p, d
+}
+
+// ReadPassword prompts for the password of a vault.
+func ReadPassword() ([]byte, error) {
+	return readPassword("Enter Password: ")
+}
+
+// ReadNewPassword prompts for a new password twice. It fails if the two do
+// not match.
+func ReadNewPassword() ([]byte, error) {
+	pw, err := readPassword("New Password: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(pw) == 0 {
+		return nil, fmt.Errorf("password is empty")
+	}
+	confirm, err := readPassword("Confirm Password: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pw, confirm) {
+		return nil, fmt.Errorf("passwords do not match")
 	}
+	return pw, nil
+}
 
+func readPassword(label string) ([]byte, error) {
 	done, err := setSecretInputTermMode(os.Stdin.Fd())
 	if err != nil {
 		return nil, err
 	}
 	defer done()
+	return readPasswordFromUser(os.Stdin, os.Stdout, label), nil
+}
 
-	const (
-		time    = 1
-		mem     = 64 * 1024
-		threads = 4
-	)
-
+// DeriveKey derives a key from a password with argon2id. The salt must be
+// at least 16 bytes.
+func DeriveKey(pw, salt []byte, p KDFParams) (tink.AEAD, error) {
+	if len(salt) < 16 {
+		return nil, fmt.Errorf("salt is too small: %d bytes, want at least 16", len(salt))
+	}
 	return aead.NewXChaCha20Poly1305(
 		argon2.IDKey(
-			readPasswordFromUser(os.Stdin, os.Stdout),
+			pw,
 			salt,
-			time,
-			mem,
-			threads,
+			p.Time,
+			p.Memory,
+			p.Threads,
 			chacha20poly1305.KeySize,
 		),
 	)
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type passwdCmd struct {
+}
+
+func (c *passwdCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "passwd",
+		Short: "Changes the password of the vault.",
+		Run:   c.run,
+	}
+}
+
+func (c *passwdCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *passwdCmd) run(cmd *cobra.Command, args []string) {
+	if err := pwdb.ChangePassword(opts); err != nil {
+		cmd.PrintErrf("failed to change password: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
@@ -56,7 +56,7 @@ func writeFileSync(path string, data []byte) (_err error) {
 	return f.Sync()
 }
 
-func writeFileAtomic(tempPath, path string, data []byte) (_err error) {
+func writeFileAtomic(tempPath, path string, data []byte) error {
 	if err := writeFileSync(tempPath, data); err != nil {
 		return err
 	}
@@ -68,7 +68,12 @@ func writeFileAtomic(tempPath, path string, data []byte) (_err error) {
 	}
 
 	// Step 5
-	dir, err := os.OpenFile(filepath.Dir(path), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that renames and removals in it are durable.
+func syncDir(path string) (_err error) {
+	dir, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,325 @@
+package pwdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// Attachments live in the attachments directory of a vault, one file each,
+// named by a random ID. A file is a vault file header followed by chunks of
+// at most attachmentChunkSize bytes of data, so that neither writing nor
+// reading an attachment needs all of it in memory. Each chunk is a flag byte
+// that is set on the last chunk, a 4 byte big endian length, and the chunk
+// encrypted with the master key. The ID, the position of the chunk and the
+// flag are bound to it as associated data, so chunks cannot be reordered,
+// moved between attachments, or dropped from the end.
+//
+// Attachment files are immutable. Compact deletes the ones that no revision
+// of any record refers to any more.
+
+const attachmentChunkSize = 64 << 10
+
+// maxAttachmentFrame bounds the length of an encrypted chunk, to reject a
+// damaged length before allocating it.
+const maxAttachmentFrame = attachmentChunkSize + 1024
+
+// minAttachmentVersion is the oldest format version of attachment files that
+// can be read. Their format has not changed since then, so migrations leave
+// them as they are.
+const minAttachmentVersion = 2
+
+func attachmentAD(id string, seq uint64, last bool) []byte {
+	return []byte(fmt.Sprintf("attachment/%s/%d/%t", id, seq, last))
+}
+
+func (db *DB) attachmentDir() string {
+	return filepath.Join(db.dir, "attachments")
+}
+
+// validAttachmentID checks that an ID names a file in the attachments
+// directory and nothing else.
+func validAttachmentID(id string) error {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 || hex.EncodeToString(b) != id {
+		return fmt.Errorf("invalid attachment id %q", id)
+	}
+	return nil
+}
+
+// Attach stores the contents of r as an attachment of a record, called file.
+// An attachment of the record with the same name is replaced.
+func (tx *Tx) Attach(name, file string, r io.Reader) error {
+	rec, err := tx.Get(name)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("attachment name is empty")
+	}
+	id, size, err := tx.db.writeAttachment(r)
+	if err != nil {
+		return fmt.Errorf("failed to write attachment: %v", err)
+	}
+	var keep []*Attachment
+	for _, a := range rec.Attachments {
+		if a.Name != file {
+			keep = append(keep, a)
+		}
+	}
+	rec.Attachments = append(keep, &Attachment{Name: file, Id: id, Size: size})
+	return tx.Put(name, rec)
+}
+
+// Detach removes an attachment from a record. Earlier revisions of the
+// record still refer to it, so its data is only deleted once they are gone.
+func (tx *Tx) Detach(name, file string) error {
+	rec, err := tx.Get(name)
+	if err != nil {
+		return err
+	}
+	var keep []*Attachment
+	for _, a := range rec.Attachments {
+		if a.Name != file {
+			keep = append(keep, a)
+		}
+	}
+	if len(keep) == len(rec.Attachments) {
+		return fmt.Errorf("%q has no attachment %q", name, file)
+	}
+	rec.Attachments = keep
+	return tx.Put(name, rec)
+}
+
+// ReadAttachment decrypts an attachment of the current revision of a record
+// to w. Data is written as it is decrypted, so if ReadAttachment fails, w may
+// have received part of the attachment.
+func (db *DB) ReadAttachment(name, file string, w io.Writer) error {
+	rec, err := db.Get(name)
+	if err != nil {
+		return err
+	}
+	for _, a := range rec.Attachments {
+		if a.Name == file {
+			return db.readAttachment(a.Id, w)
+		}
+	}
+	return fmt.Errorf("%q has no attachment %q", name, file)
+}
+
+// writeAttachment encrypts r into a new attachment file and returns its ID
+// and the size of the data.
+func (db *DB) writeAttachment(r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(db.attachmentDir(), 0700); err != nil {
+		return "", 0, err
+	}
+	id := hex.EncodeToString(random.GetRandomBytes(16))
+	size, err := db.writeAttachmentFile(id, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return id, size, nil
+}
+
+// writeAttachmentFile encrypts r into the attachment file with the given ID,
+// atomically replacing it if it exists, and returns the size of the data.
+func (db *DB) writeAttachmentFile(id string, r io.Reader) (size int64, _err error) {
+	path := filepath.Join(db.attachmentDir(), id)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := f.Close(); _err == nil {
+			_err = err
+		}
+		if _err != nil {
+			os.Remove(path + ".tmp")
+		}
+	}()
+	w := bufio.NewWriter(f)
+	h, err := withHeader(&Header{FormatVersion: formatVersion}, nil)
+	if err != nil {
+		return 0, err
+	}
+	w.Write(h)
+
+	// A chunk is only known to be the last one once the next read finds
+	// nothing, so read one chunk ahead.
+	cur := make([]byte, attachmentChunkSize)
+	next := make([]byte, attachmentChunkSize)
+	n, err := io.ReadFull(r, cur)
+	for seq := uint64(0); ; seq++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		var m int
+		var nextErr error
+		if !last {
+			m, nextErr = io.ReadFull(r, next)
+			last = m == 0 && nextErr == io.EOF
+		}
+		c, err := db.master.Encrypt(cur[:n], attachmentAD(id, seq, last))
+		if err != nil {
+			return 0, err
+		}
+		var frame [5]byte
+		if last {
+			frame[0] = 1
+		}
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(c)))
+		w.Write(frame[:])
+		w.Write(c)
+		size += int64(n)
+		if last {
+			break
+		}
+		cur, next = next, cur
+		n, err = m, nextErr
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return 0, err
+	}
+	return size, syncDir(db.attachmentDir())
+}
+
+func (db *DB) readAttachment(id string, w io.Writer) error {
+	if err := validAttachmentID(id); err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(db.attachmentDir(), id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if err := readHeader(r); err != nil {
+		return fmt.Errorf("attachment %s: %v", id, err)
+	}
+	for seq := uint64(0); ; seq++ {
+		var frame [5]byte
+		if _, err := io.ReadFull(r, frame[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("attachment %s is truncated", id)
+			}
+			return err
+		}
+		last := frame[0] == 1
+		n := binary.BigEndian.Uint32(frame[1:])
+		if frame[0] > 1 || n > maxAttachmentFrame {
+			return fmt.Errorf("attachment %s is damaged at chunk %d", id, seq)
+		}
+		c := make([]byte, n)
+		if _, err := io.ReadFull(r, c); err != nil {
+			return fmt.Errorf("attachment %s is truncated", id)
+		}
+		b, err := db.master.Decrypt(c, attachmentAD(id, seq, last))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt chunk %d of attachment %s", seq, id)
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if last {
+			if _, err := r.ReadByte(); err != io.EOF {
+				return fmt.Errorf("attachment %s has trailing data", id)
+			}
+			return nil
+		}
+	}
+}
+
+// readHeader reads the vault file header at the start of r and checks its
+// version.
+func readHeader(r io.Reader) error {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return fmt.Errorf("short header")
+	}
+	if string(prefix[:4]) != string(magic) {
+		return fmt.Errorf("missing header")
+	}
+	n := binary.BigEndian.Uint32(prefix[4:])
+	if n > 1<<10 {
+		return fmt.Errorf("header is too long")
+	}
+	hb := make([]byte, n)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return fmt.Errorf("short header")
+	}
+	var h Header
+	if err := proto.Unmarshal(hb, &h); err != nil {
+		return err
+	}
+	if h.FormatVersion < minAttachmentVersion || h.FormatVersion > formatVersion {
+		return fmt.Errorf("unsupported format version %d", h.FormatVersion)
+	}
+	return nil
+}
+
+// removeUnusedAttachments deletes the attachment files that no revision of
+// any record, in the trash or not, refers to. If some revision cannot be
+// read, nothing is deleted.
+func (db *DB) removeUnusedAttachments() error {
+	fis, err := ioutil.ReadDir(db.attachmentDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	used := map[string]bool{}
+	visit := func(env *Envelope) error {
+		revs := append([]*Revision{{Data: env.Data}}, env.History...)
+		for _, rev := range revs {
+			r, err := db.decrypt(env.Name, rev.Data)
+			if err != nil {
+				return err
+			}
+			for _, a := range r.Attachments {
+				used[a.Id] = true
+			}
+		}
+		return nil
+	}
+	for _, env := range db.records {
+		if err := visit(env); err != nil {
+			return nil
+		}
+	}
+	for _, e := range db.trash {
+		if err := visit(e.Envelope); err != nil {
+			return nil
+		}
+	}
+	removed := false
+	for _, fi := range fis {
+		if !used[fi.Name()] {
+			if err := os.Remove(filepath.Join(db.attachmentDir(), fi.Name())); err != nil {
+				return err
+			}
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(db.attachmentDir())
+}
@@ -0,0 +1,191 @@
+package pwdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Each Envelope is bound to its name, but that does not stop anyone who can
+// write pw.db from dropping records or swapping in an older copy of the
+// file. Every commit therefore increments a generation counter and seals a
+// digest of the whole RecordSet with the master key. The last generation
+// that was committed is also kept in the generation file of the vault, so
+// that replacing pw.db and pw.log with an older pair is noticed, and in a
+// per-user state file outside of the vault, named after the vault directory,
+// so that replacing the whole directory with an older copy is noticed too.
+// Only the state file of the user and machine that committed protects the
+// vault: a copy of the vault at another path, or a vault synced to another
+// machine, is only checked against its own generation file.
+
+var (
+	authenticatorAD = []byte("pw.db/authenticator")
+	generationAD    = []byte("generation")
+)
+
+// digest hashes the generation, records, trash and trash retention. A
+// retention that was never set is left out, so that vaults from before it
+// could be set keep their authenticator.
+func (db *DB) digest(generation uint64) ([]byte, error) {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, generation)
+	write := func(m proto.Message) error {
+		var buf proto.Buffer
+		buf.SetDeterministic(true)
+		if err := buf.Marshal(m); err != nil {
+			return err
+		}
+		binary.Write(h, binary.BigEndian, uint64(len(buf.Bytes())))
+		h.Write(buf.Bytes())
+		return nil
+	}
+	names := db.List("")
+	binary.Write(h, binary.BigEndian, uint64(len(names)))
+	for _, name := range names {
+		if err := write(db.records[name]); err != nil {
+			return nil, err
+		}
+	}
+	binary.Write(h, binary.BigEndian, uint64(len(db.trash)))
+	for _, e := range db.trash {
+		if err := write(e); err != nil {
+			return nil, err
+		}
+	}
+	if db.retention != 0 {
+		binary.Write(h, binary.BigEndian, int64(db.retention/time.Second))
+	}
+	return h.Sum(nil), nil
+}
+
+// seal increments the generation and returns an authenticator for the
+// current state.
+func (db *DB) seal() ([]byte, error) {
+	db.generation++
+	d, err := db.digest(db.generation)
+	if err != nil {
+		return nil, err
+	}
+	return db.master.Encrypt(d, authenticatorAD)
+}
+
+// verify checks the current state against its authenticator.
+func (db *DB) verify(authenticator []byte) error {
+	d, err := db.digest(db.generation)
+	if err != nil {
+		return err
+	}
+	want, err := db.master.Decrypt(authenticator, authenticatorAD)
+	if err != nil || !hmac.Equal(d, want) {
+		return errors.New("vault does not match its authenticator: records were removed, added or altered outside of pwstore")
+	}
+	return nil
+}
+
+// checkGeneration checks that the current state is not older than the last
+// committed generation.
+func (db *DB) checkGeneration() error {
+	last, err := db.readGeneration()
+	if err != nil {
+		return err
+	}
+	if db.generation < last && !db.acceptRollback {
+		return fmt.Errorf("vault is at generation %d but generation %d was already committed: the vault may have been replaced with an older copy. If this is a deliberate restore, use --force-accept-rollback", db.generation, last)
+	}
+	if !db.acceptRollback || db.readOnly {
+		return nil
+	}
+	// Accept the vault as it is, including a state file of another vault.
+	return db.writeGeneration()
+}
+
+// readGeneration returns the last committed generation recorded in the
+// vault or in its state file, whichever is later.
+func (db *DB) readGeneration() (uint64, error) {
+	last, err := db.readGenerationFile(filepath.Join(db.dir, "generation"))
+	if err != nil {
+		return 0, err
+	}
+	if db.stateFile == "" {
+		return last, nil
+	}
+	g, err := db.readGenerationFile(db.stateFile)
+	if err == errGenerationKey {
+		// The state file belongs to another vault that was at this path.
+		// An empty vault has nothing to roll back, and a new one overwrites
+		// the file with its first commit.
+		if db.generation == 0 || db.acceptRollback {
+			return last, nil
+		}
+		return 0, fmt.Errorf("vault was replaced with another one since it was last used: %q does not match it. If this is deliberate, use --force-accept-rollback", db.stateFile)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if g > last {
+		last = g
+	}
+	return last, nil
+}
+
+var errGenerationKey = errors.New("generation was written with another key")
+
+func (db *DB) readGenerationFile(path string) (uint64, error) {
+	_, c, err := readVaultFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	b, err := db.master.Decrypt(c, generationAD)
+	if err != nil {
+		return 0, errGenerationKey
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("failed to decrypt %q", path)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// writeGeneration records the current generation in the vault and in its
+// state file.
+func (db *DB) writeGeneration() error {
+	c, err := db.sealGeneration()
+	if err != nil {
+		return err
+	}
+	if err := writeVaultFile(filepath.Join(db.dir, "generation"), nil, c); err != nil {
+		return err
+	}
+	return db.writeStateGeneration()
+}
+
+// writeStateGeneration records the current generation in the state file
+// only.
+func (db *DB) writeStateGeneration() error {
+	if db.stateFile == "" {
+		return nil
+	}
+	c, err := db.sealGeneration()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(db.stateFile), 0700); err != nil {
+		return err
+	}
+	return writeVaultFile(db.stateFile, nil, c)
+}
+
+func (db *DB) sealGeneration() ([]byte, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], db.generation)
+	return db.master.Encrypt(b[:], generationAD)
+}
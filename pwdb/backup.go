@@ -0,0 +1,323 @@
+package pwdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// DefaultBackups is the default number of automatic backups to keep.
+const DefaultBackups = 10
+
+// backupIDFormat is the time layout of the IDs of automatic backups. Other
+// backups, e.g. the ones made by Migrate, are never rotated.
+const backupIDFormat = "20060102-150405.000"
+
+// A restore cannot replace the vault files one at a time, since a crash
+// partway through would leave files from different states. The backup is
+// first copied into restoreTmp, which is renamed to restorePending once it
+// is complete. The rename commits the restore. finishRestore, which runs
+// whenever the vault is locked exclusively, then copies the files into the
+// vault, removes the ones the backup does not have, and removes
+// restorePending. Copying, unlike renaming, can be repeated if finishRestore
+// is interrupted.
+const (
+	restoreTmp     = "restore.tmp"
+	restorePending = "restore.pending"
+)
+
+// A backup holds the records of the vault, not its keys. It is unlocked with
+// the current slots of the vault, so that changing or removing a secret
+// revokes it for the backups too. Backups made before this, and the ones
+// Migrate makes, may hold salt, master or slots files, which
+// removeBackupKeys drops whenever a secret changes. A backup whose records
+// the master keyset can no longer decrypt is of no use, so rekey removes
+// every backup before it destroys the old keys, and EncryptNames removes
+// every backup since they hold plaintext names. Copying a backup over the
+// vault by hand is caught like any other rollback.
+
+// recordFiles are the vault files that a backup keeps.
+var recordFiles = []string{"pw.db", "pw.log", "generation"}
+
+// Backup is a copy of the records of the vault in the backups directory.
+type Backup struct {
+	ID   string
+	Time time.Time
+}
+
+// backup copies the vault to a new automatic backup before the first write
+// of this DB, and removes the oldest automatic backups beyond the limit.
+// Backing up on every commit would cost as much as the rewrites that pw.log
+// saves, so a process that commits many times gets a single backup.
+func (db *DB) backup() error {
+	if db.backedUp || db.backups < 0 || db.generation == 0 {
+		return nil
+	}
+	if _, err := backupVault(db.dir, time.Now().UTC().Format(backupIDFormat), recordFiles); err != nil {
+		return fmt.Errorf("failed to back up vault: %v", err)
+	}
+	db.backedUp = true
+
+	backups, err := listBackups(db.dir)
+	if err != nil {
+		return err
+	}
+	var auto []string
+	for _, b := range backups {
+		if _, err := time.Parse(backupIDFormat, b.ID); err == nil {
+			auto = append(auto, b.ID)
+		}
+	}
+	for len(auto) > db.backups {
+		if err := os.RemoveAll(filepath.Join(db.dir, "backups", auto[0])); err != nil {
+			return err
+		}
+		auto = auto[1:]
+	}
+	return nil
+}
+
+// backupVault copies files and the attachments of the vault to a new
+// directory under backups.
+func backupVault(dir, name string, files []string) (string, error) {
+	backup := filepath.Join(dir, "backups", name)
+	if err := copyVaultFiles(dir, backup, files); err != nil {
+		return "", err
+	}
+	return backup, nil
+}
+
+// copyVaultFiles copies those of files and the attachments that exist in
+// from to a new directory to.
+func copyVaultFiles(from, to string, files []string) error {
+	if err := os.MkdirAll(to, 0700); err != nil {
+		return err
+	}
+	for _, name := range files {
+		b, err := ioutil.ReadFile(filepath.Join(from, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := writeFile(filepath.Join(to, name), b); err != nil {
+			return err
+		}
+	}
+	return copyAttachments(from, to)
+}
+
+// copyAttachments adds the attachment files of the vault in from to the
+// attachments directory of to. Attachment files are immutable, so they are
+// hard linked where possible, and ones that to already has are kept. A
+// backup thus keeps the attachments its records refer to, even once the
+// vault no longer does, without taking up space for them.
+func copyAttachments(from, to string) error {
+	fis, err := ioutil.ReadDir(filepath.Join(from, "attachments"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	dir := filepath.Join(to, "attachments")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || validAttachmentID(fi.Name()) != nil {
+			continue
+		}
+		if err := linkFile(filepath.Join(from, "attachments", fi.Name()), filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// linkFile hard links src to dst, or copies it if it cannot be linked.
+// Attachment files are never modified, so they can be shared. An existing
+// dst is left as is.
+func linkFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || os.IsExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFile(dst, b)
+}
+
+// ListBackups returns the backups of the selected vault, oldest first.
+func ListBackups(opts Options) ([]Backup, error) {
+	dir, err := opts.Path()
+	if err != nil {
+		return nil, err
+	}
+	return listBackups(dir)
+}
+
+func listBackups(dir string) ([]Backup, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(dir, "backups"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var out []Backup
+	for _, fi := range fis {
+		if fi.IsDir() {
+			out = append(out, Backup{ID: fi.Name(), Time: fi.ModTime()})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// RestoreBackup replaces the records of the selected vault with the ones in
+// one of its backups. The backup is unlocked with the slots of the vault and
+// verified first, and the current vault is backed up so that the restore can
+// be undone.
+func RestoreBackup(opts Options, id string) error {
+	// We want the permissions we specify to be respected.
+	syscall.Umask(0)
+
+	dir, err := opts.Path()
+	if err != nil {
+		return err
+	}
+	if id == "" || filepath.Base(id) != id {
+		return fmt.Errorf("invalid backup %q", id)
+	}
+	backupDir := filepath.Join(dir, "backups", id)
+	if _, err := os.Stat(backupDir); err != nil {
+		return fmt.Errorf("backup %q not found", id)
+	}
+	if err := acquireLock(filepath.Join(dir, "lock"), true, opts); err != nil {
+		return err
+	}
+	if err := finishRestore(dir); err != nil {
+		return err
+	}
+	if err := checkVersion(backupDir); err != nil {
+		return fmt.Errorf("backup %q: %v", id, err)
+	}
+
+	key, err := unlockMaster(opts, dir)
+	if err != nil {
+		return err
+	}
+	db := newDB(backupDir, key)
+	db.readOnly = true
+	authenticator, err := db.readState()
+	if err != nil {
+		return fmt.Errorf("failed to read backup %q: %v", id, err)
+	}
+	if err := db.verify(authenticator); err != nil {
+		return fmt.Errorf("failed to verify backup %q: %v", id, err)
+	}
+
+	if _, err := backupVault(dir, "pre-restore-"+time.Now().UTC().Format(backupIDFormat), recordFiles); err != nil {
+		return fmt.Errorf("failed to back up vault: %v", err)
+	}
+	tmp := filepath.Join(dir, restoreTmp)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := copyVaultFiles(backupDir, tmp, recordFiles); err != nil {
+		return err
+	}
+	// The restored vault is older than the last commit, which is fine since
+	// it is restored on purpose.
+	if db.stateFile, err = opts.generationFile(dir); err != nil {
+		return err
+	}
+	if err := db.writeStateGeneration(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, restorePending)); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return finishRestore(dir)
+}
+
+// hasPendingRestore reports whether a restore of the vault in dir was
+// committed but not finished.
+func hasPendingRestore(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, restorePending))
+	return err == nil
+}
+
+// finishRestore completes a committed restore, if there is one. The vault
+// must be locked exclusively.
+func finishRestore(dir string) error {
+	pending := filepath.Join(dir, restorePending)
+	if !hasPendingRestore(dir) {
+		return nil
+	}
+	for _, name := range recordFiles {
+		b, err := ioutil.ReadFile(filepath.Join(pending, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := writeFile(filepath.Join(dir, name), b); err != nil {
+			return err
+		}
+	}
+	// Attachments the restored records no longer refer to are removed by
+	// the next Compact.
+	if err := copyAttachments(pending, dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(pending); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// removeBackupKeys removes the files that hold keys from every backup of the
+// vault in dir, so that the secrets they were wrapped with no longer unlock
+// anything.
+func removeBackupKeys(dir string) error {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		backupDir := filepath.Join(dir, "backups", b.ID)
+		for _, name := range []string{"salt", "master", slotsFile, keyChangeFile} {
+			if err := os.Remove(filepath.Join(backupDir, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := syncDir(backupDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeBackups removes every backup of the vault in dir.
+func removeBackups(dir string) error {
+	if err := os.RemoveAll(filepath.Join(dir, "backups")); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
@@ -1,54 +1,93 @@
 package pwdb
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/tink/go/aead"
-	"github.com/google/tink/go/keyset"
-	"github.com/google/tink/go/subtle/random"
 	"github.com/google/tink/go/tink"
 	"github.com/mikedanese/pwstore/passwd"
-	"golang.org/x/sys/unix"
 )
 
-func Open() (*DB, error) {
+func Open(opts Options) (*DB, error) {
 	// We want the permissions we specify to be respected.
 	syscall.Umask(0)
 
-	homeDir, err := os.UserHomeDir()
+	name, err := opts.vault()
 	if err != nil {
-		return nil, fmt.Errorf("unable to find user home dir: %v", err)
+		return nil, err
+	}
+	pwDir, err := opts.Path()
+	if err != nil {
+		return nil, err
+	}
+	if name != DefaultVault {
+		// Only the default vault is created implicitly.
+		if _, err := os.Stat(pwDir); os.IsNotExist(err) {
+			return nil, fmt.Errorf("vault %q does not exist", name)
+		}
 	}
-	pwDir := filepath.Join(homeDir, ".pwstore")
 	if err := os.MkdirAll(pwDir, 0700); err != nil {
 		return nil, err
 	}
 
-	fd, err := unix.Open(filepath.Join(pwDir, "lock"), unix.O_CREAT|unix.O_WRONLY, 0600)
-	if err != nil {
+	readOnly := opts.ReadOnly
+	if _, err := os.Stat(filepath.Join(pwDir, slotsFile)); os.IsNotExist(err) || opts.ForceAcceptRollback {
+		// Initializing a vault and accepting a rollback write to it.
+		readOnly = false
+	}
+	exclusive := !readOnly
+	if hasPendingRestore(pwDir) {
+		// Finishing an interrupted restore writes to the vault.
+		exclusive = true
+	}
+	if err := acquireLock(filepath.Join(pwDir, "lock"), exclusive, opts); err != nil {
 		return nil, err
 	}
-	// Hold lock until process exits.
-	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
-		return nil, fmt.Errorf("failed to acquire DB lock: %v", err)
+	if exclusive {
+		if err := finishRestore(pwDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkVersion(pwDir); err != nil {
+		return nil, err
 	}
 
-	key, err := loadMasterAEAD(pwDir)
+	key, err := loadMasterAEAD(opts, pwDir)
 	if err != nil {
 		return nil, err
 	}
+	return openWithKey(opts, pwDir, key, readOnly)
+}
 
-	db := &DB{
-		dir:     pwDir,
-		records: make(map[string][]byte),
-		master:  key,
+// openWithKey loads the vault in dir, which the caller has locked, with the
+// given master key.
+func openWithKey(opts Options, pwDir string, key tink.AEAD, readOnly bool) (*DB, error) {
+	db := newDB(pwDir, key)
+	stateFile, err := opts.generationFile(pwDir)
+	if err != nil {
+		return nil, err
+	}
+	db.stateFile = stateFile
+	db.compactThreshold = opts.CompactThreshold
+	db.backups = opts.Backups
+	db.readOnly = readOnly
+	db.acceptRollback = opts.ForceAcceptRollback
+	if db.compactThreshold == 0 {
+		db.compactThreshold = DefaultCompactThreshold
+	}
+	if db.backups == 0 {
+		db.backups = DefaultBackups
 	}
 	if err := db.load(); err != nil {
 		return nil, err
@@ -56,26 +95,263 @@ func Open() (*DB, error) {
 	return db, nil
 }
 
+var errReadOnly = errors.New("DB is opened read-only")
+
+// newDB returns an empty DB for the vault in dir, which is neither loaded
+// nor locked.
+func newDB(dir string, master tink.AEAD) *DB {
+	return &DB{
+		dir:     dir,
+		master:  master,
+		records: make(map[string]*Envelope),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// maxHistory is the number of earlier revisions kept for each record.
+const maxHistory = 10
+
 type DB struct {
-	dir     string
-	master  tink.AEAD
-	records map[string][]byte
+	dir      string
+	master   tink.AEAD
+	records  map[string]*Envelope
+	trash    []*TrashEntry
+	readOnly bool
+
+	// retention is the trash retention stored in the vault, as in
+	// RecordSet.trash_retention_seconds, and retentionDirty whether it
+	// changed since the last commit.
+	retention      time.Duration
+	retentionDirty bool
+
+	generation     uint64
+	nameKey        []byte
+	acceptRollback bool
+	// stateFile is the per-user state file that records the last generation
+	// committed to the vault, if any.
+	stateFile string
+
+	// backups is the number of automatic backups to keep, and backedUp
+	// whether this DB has made one yet.
+	backups  int
+	backedUp bool
+
+	// dirty holds the names of records changed since the last commit, and
+	// trashDirty whether the trash changed.
+	dirty      map[string]bool
+	trashDirty bool
+
+	// logSeq is the number of entries in pw.log and logSize its size. logTorn
+	// is whether a torn entry follows them.
+	logSeq           uint64
+	logSize          int64
+	logTorn          bool
+	compactThreshold int64
 }
 
-func (db *DB) List() []string {
+// List returns the sorted names of all records in a folder and its
+// subfolders. An empty folder lists every record.
+func (db *DB) List(folder string) []string {
+	prefix := folderPrefix(folder)
 	names := []string{}
 	for name, _ := range db.records {
-		names = append(names, name)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
 	}
 	sort.Strings(names)
 	return names
 }
 
 func (db *DB) Get(name string) (*Record, error) {
-	c, ok := db.records[name]
+	return db.GetRevision(name, 0)
+}
+
+// GetRevision returns revision n of a record. Revision 0 is the current
+// record, 1 the one before it, and so on.
+func (db *DB) GetRevision(name string, n int) (*Record, error) {
+	c, err := db.revision(name, n)
+	if err != nil {
+		return nil, err
+	}
+	return db.decrypt(name, c.Data)
+}
+
+// History returns the update time of every revision of a record, indexed by
+// revision number. Times are zero for revisions written before update times
+// were recorded.
+func (db *DB) History(name string) ([]time.Time, error) {
+	env, ok := db.records[name]
+	if !ok {
+		return nil, fmt.Errorf("password %q not found", name)
+	}
+	tss := []*timestamp.Timestamp{env.UpdateTime}
+	for _, rev := range env.History {
+		tss = append(tss, rev.UpdateTime)
+	}
+	var out []time.Time
+	for _, ts := range tss {
+		var t time.Time
+		if ts != nil {
+			var err error
+			if t, err = ptypes.Timestamp(ts); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (db *DB) Put(name string, r *Record) error {
+	return db.Update(func(tx *Tx) error { return tx.Put(name, r) })
+}
+
+// Rollback makes revision n the current revision of a record. The current
+// revision is kept in the history, so a rollback can itself be undone.
+func (db *DB) Rollback(name string, n int) error {
+	return db.Update(func(tx *Tx) error { return tx.Rollback(name, n) })
+}
+
+// Delete moves a record and its history to the trash.
+func (db *DB) Delete(name string) error {
+	return db.Update(func(tx *Tx) error { return tx.Delete(name) })
+}
+
+// Rename moves a record and its history to a new name. Since the name is
+// bound to the ciphertext, every revision is re-encrypted. If from is a
+// folder, every record in it is moved into the folder to.
+func (db *DB) Rename(from, to string) error {
+	return db.Update(func(tx *Tx) error { return tx.Rename(from, to) })
+}
+
+// Duplicate copies the current revision of a record to a new name.
+func (db *DB) Duplicate(from, to string) error {
+	return db.Update(func(tx *Tx) error { return tx.Duplicate(from, to) })
+}
+
+// Match returns the sorted names of all records that match a path.Match
+// pattern. A pattern that ends in a Separator matches every record in that
+// folder.
+func (db *DB) Match(pattern string) ([]string, error) {
+	if IsFolder(pattern) {
+		return db.List(pattern), nil
+	}
+	var names []string
+	for _, name := range db.List("") {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// reseal returns a copy of a record's envelope with every revision
+// re-encrypted under a new name.
+func (db *DB) reseal(from, to string) (*Envelope, error) {
+	env, ok := db.records[from]
+	if !ok {
+		return nil, fmt.Errorf("password %q not found", from)
+	}
+	if _, ok := db.records[to]; ok {
+		return nil, fmt.Errorf("password %q already exists", to)
+	}
+	reencrypt := func(c []byte) ([]byte, error) {
+		b, err := db.master.Decrypt(c, []byte(from))
+		if err != nil {
+			return nil, err
+		}
+		return db.master.Encrypt(b, []byte(to))
+	}
+	data, err := reencrypt(env.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt %q: %v", from, err)
+	}
+	out := &Envelope{
+		Name:       to,
+		Data:       data,
+		UpdateTime: env.UpdateTime,
+	}
+	if env.Metadata != nil {
+		m, err := db.master.Decrypt(env.Metadata, metadataAD(from))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt metadata of %q: %v", from, err)
+		}
+		if out.Metadata, err = db.master.Encrypt(m, metadataAD(to)); err != nil {
+			return nil, err
+		}
+	}
+	for i, rev := range env.History {
+		data, err := reencrypt(rev.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt revision %d of %q: %v", i+1, from, err)
+		}
+		out.History = append(out.History, &Revision{
+			Data:       data,
+			UpdateTime: rev.UpdateTime,
+		})
+	}
+	return out, nil
+}
+
+// putEnvelope adds or replaces a record, to be written by the next commit.
+func (db *DB) putEnvelope(env *Envelope) {
+	db.records[env.Name] = env
+	db.dirty[env.Name] = true
+}
+
+// removeEnvelope removes a record, to be written by the next commit.
+func (db *DB) removeEnvelope(name string) {
+	delete(db.records, name)
+	db.dirty[name] = true
+}
+
+// setData makes c, the encryption of r, the current data of a record,
+// pushing the previous data into its history. The old Envelope is left
+// untouched.
+func (db *DB) setData(name string, c []byte, r *Record) error {
+	m, err := db.sealMetadata(name, r)
+	if err != nil {
+		return err
+	}
+	env := &Envelope{
+		Name:       name,
+		Data:       c,
+		UpdateTime: ptypes.TimestampNow(),
+		Metadata:   m,
+	}
+	if prev, ok := db.records[name]; ok {
+		env.History = append([]*Revision{{
+			Data:       prev.Data,
+			UpdateTime: prev.UpdateTime,
+		}}, prev.History...)
+		if len(env.History) > maxHistory {
+			env.History = env.History[:maxHistory]
+		}
+	}
+	db.putEnvelope(env)
+	return nil
+}
+
+func (db *DB) revision(name string, n int) (*Revision, error) {
+	env, ok := db.records[name]
 	if !ok {
 		return nil, fmt.Errorf("password %q not found", name)
 	}
+	if n == 0 {
+		return &Revision{Data: env.Data, UpdateTime: env.UpdateTime}, nil
+	}
+	if n < 0 || n > len(env.History) {
+		return nil, fmt.Errorf("password %q has no revision %d", name, n)
+	}
+	return env.History[n-1], nil
+}
+
+func (db *DB) decrypt(name string, c []byte) (*Record, error) {
 	b, err := db.master.Decrypt(c, []byte(name))
 	if err != nil {
 		return nil, err
@@ -87,105 +363,258 @@ func (db *DB) Get(name string) (*Record, error) {
 	return &out, nil
 }
 
-func (db *DB) Put(name string, r *Record) error {
-	b, err := proto.Marshal(r)
+func (db *DB) load() error {
+	authenticator, err := db.readState()
 	if err != nil {
 		return err
 	}
-	c, err := db.master.Encrypt(b, []byte(name))
-	if err != nil {
+	if db.generation > 0 {
+		if err := db.verify(authenticator); err != nil {
+			return err
+		}
+	}
+	if err := db.checkGeneration(); err != nil {
 		return err
 	}
-	db.records[name] = c
-	return db.commit()
+	if db.logTorn && !db.readOnly {
+		// Only drop the torn entry once the state before it checks out, in
+		// case it is a committed entry with a damaged length.
+		if err := db.truncateLog(); err != nil {
+			return err
+		}
+	}
+	if db.generation == 0 && !db.readOnly {
+		// This is a new vault.
+		return db.Compact()
+	}
+	return nil
 }
 
-func (db *DB) load() error {
+// readState loads the snapshot and replays the log on top of it. It returns
+// the authenticator of the resulting state.
+func (db *DB) readState() ([]byte, error) {
 	pwPath := filepath.Join(db.dir, "pw.db")
 	var rs RecordSet
-	b, err := ioutil.ReadFile(pwPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return db.commit()
-		}
-		return err
+	_, b, err := readVaultFile(pwPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
 	if err := proto.Unmarshal(b, &rs); err != nil {
-		return err
+		return nil, err
 	}
-	records := make(map[string][]byte)
+	if err := db.loadNameKey(rs.NameKey); err != nil {
+		return nil, err
+	}
+	records := make(map[string]*Envelope)
 	for _, env := range rs.Records {
-		records[env.Name] = env.Data
+		env, err := db.openName(env)
+		if err != nil {
+			return nil, err
+		}
+		records[env.Name] = env
 	}
 	db.records = records
-	return nil
+	if db.trash, err = db.openTrash(rs.Trash); err != nil {
+		return nil, err
+	}
+	db.generation = rs.Generation
+	db.retention = time.Duration(rs.TrashRetentionSeconds) * time.Second
+	authenticator := rs.Authenticator
+	if err := db.replayLog(func(e *LogEntry) {
+		authenticator = e.Authenticator
+	}); err != nil {
+		return nil, err
+	}
+	return authenticator, nil
 }
 
+// commit appends the changes made since the last commit to pw.log, and
+// compacts the log once it grows past the threshold.
 func (db *DB) commit() error {
-	pwPath := filepath.Join(db.dir, "pw.db")
-	var rs RecordSet
-	for name, val := range db.records {
-		rs.Records = append(rs.Records, &Envelope{
-			Name: name,
-			Data: val,
-		})
+	if db.readOnly {
+		return errReadOnly
 	}
-	b, err := proto.Marshal(&rs)
+	if err := db.backup(); err != nil {
+		return err
+	}
+	if db.purgeTrash(time.Now()) {
+		db.trashDirty = true
+	}
+	var names []string
+	for name := range db.dirty {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var e LogEntry
+	for _, name := range names {
+		if env, ok := db.records[name]; ok {
+			env, err := db.sealName(env)
+			if err != nil {
+				return err
+			}
+			e.Put = append(e.Put, env)
+		} else if db.nameKey != nil {
+			c, err := db.master.Encrypt([]byte(name), deleteAD)
+			if err != nil {
+				return err
+			}
+			e.EncryptedDelete = append(e.EncryptedDelete, c)
+		} else {
+			e.Delete = append(e.Delete, name)
+		}
+	}
+	if db.trashDirty {
+		e.TrashChanged = true
+		trash, err := db.sealTrash(db.trash)
+		if err != nil {
+			return err
+		}
+		e.Trash = trash
+	}
+	if db.retentionDirty {
+		e.RetentionChanged = true
+		e.TrashRetentionSeconds = int64(db.retention / time.Second)
+	}
+	authenticator, err := db.seal()
 	if err != nil {
 		return err
 	}
-	return writeFile(pwPath, b)
+	e.Generation = db.generation
+	e.Authenticator = authenticator
+	if err := db.appendLog(&e); err != nil {
+		return err
+	}
+	db.dirty = make(map[string]bool)
+	db.trashDirty = false
+	db.retentionDirty = false
+	if err := db.writeGeneration(); err != nil {
+		return err
+	}
+	if db.logSize > db.compactThreshold {
+		return db.Compact()
+	}
+	return nil
 }
 
-func loadMasterAEAD(pwDir string) (tink.AEAD, error) {
-	// load salt
-	saltPath := filepath.Join(pwDir, "salt")
-	salt, err := ioutil.ReadFile(saltPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, fmt.Errorf("failed to read salt from %q: %v", saltPath, err)
+// Compact writes every record to a new snapshot in pw.db and truncates
+// pw.log.
+func (db *DB) Compact() error {
+	if db.readOnly {
+		return errReadOnly
+	}
+	if err := db.backup(); err != nil {
+		return err
+	}
+	db.purgeTrash(time.Now())
+	db.addMissingMetadata()
+	var rs RecordSet
+	for _, name := range db.List("") {
+		env, err := db.sealName(db.records[name])
+		if err != nil {
+			return err
 		}
-		salt = random.GetRandomBytes(16)
-		if err := writeFile(saltPath, salt); err != nil {
-			return nil, fmt.Errorf("failed to write initial salt to %q: %v", saltPath, err)
+		rs.Records = append(rs.Records, env)
+	}
+	trash, err := db.sealTrash(db.trash)
+	if err != nil {
+		return err
+	}
+	rs.Trash = trash
+	rs.TrashRetentionSeconds = int64(db.retention / time.Second)
+	if db.nameKey != nil {
+		if rs.NameKey, err = db.master.Encrypt(db.nameKey, nameKeyAD); err != nil {
+			return err
 		}
 	}
-
-	pwKey, err := passwd.Read(salt)
+	authenticator, err := db.seal()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read password: %v", err)
+		return err
 	}
-
-	// load master secret
-	masterPath := filepath.Join(pwDir, "master")
-	masterb, err := ioutil.ReadFile(masterPath)
+	rs.Generation = db.generation
+	rs.Authenticator = authenticator
+	b, err := proto.Marshal(&rs)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, fmt.Errorf("failed to read master from %q: %v", masterPath, err)
-		}
+		return err
+	}
+	if err := writeVaultFile(filepath.Join(db.dir, "pw.db"), nil, b); err != nil {
+		return err
+	}
+	// Entries of the old log are skipped when it is replayed on top of the
+	// new snapshot, so a crash before the log is removed loses nothing.
+	if err := db.removeLog(); err != nil {
+		return err
+	}
+	db.dirty = make(map[string]bool)
+	db.trashDirty = false
+	db.retentionDirty = false
+	if err := db.writeGeneration(); err != nil {
+		return err
+	}
+	return db.removeUnusedAttachments()
+}
 
-		h, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
-		if err != nil {
-			return nil, err
-		}
+// loadMasterAEAD unlocks the master key of the vault in pwDir, and creates
+// the slots of a new vault if there are none.
+func loadMasterAEAD(opts Options, pwDir string) (tink.AEAD, error) {
+	if _, err := os.Stat(filepath.Join(pwDir, slotsFile)); os.IsNotExist(err) {
+		return createSlots(opts, pwDir)
+	}
+	return unlockMaster(opts, pwDir)
+}
 
-		var buf bytes.Buffer
-		if err := h.Write(keyset.NewBinaryWriter(&buf), pwKey); err != nil {
-			return nil, fmt.Errorf("failed to write initial master keyset: %v", err)
-		}
+// unlockMaster unlocks the master key of the existing vault in pwDir. Unlike
+// loadMasterAEAD it never writes to the vault, so it is safe under a shared
+// lock.
+func unlockMaster(opts Options, pwDir string) (tink.AEAD, error) {
+	ss, err := readSlots(pwDir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("vault in %q has no key slots", pwDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := openMaster(ss, vaultKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.New(h)
+}
 
-		if err := writeFile(masterPath, buf.Bytes()); err != nil {
-			return nil, fmt.Errorf("failed to write initial master keyset to %q: %v", masterPath, err)
+// createSlots writes the slots of a new vault, with a password slot for a
+// password prompted for and the keyfile selected by opts, if any.
+func createSlots(opts Options, pwDir string) (tink.AEAD, error) {
+	path, err := opts.keyfile()
+	if err != nil {
+		return nil, err
+	}
+	var keyfile []byte
+	if path != "" {
+		if keyfile, err = hashKeyfile(path); err != nil {
+			return nil, err
 		}
-		masterb = buf.Bytes()
 	}
-	ks, err := keyset.Read(keyset.NewBinaryReader(bytes.NewReader(masterb)), pwKey)
+	pw, err := passwd.ReadPassword()
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt master keyset: %v", err)
+		return nil, fmt.Errorf("failed to read password: %v", err)
 	}
-	key, err := aead.New(ks)
+	ss, key, err := newSlotSet(pw, keyfile)
 	if err != nil {
 		return nil, err
 	}
+	if err := writeSlots(pwDir, ss); err != nil {
+		return nil, fmt.Errorf("failed to write initial key slots: %v", err)
+	}
+	if opts.Keyfile != "" {
+		if path, err = filepath.Abs(path); err != nil {
+			return nil, err
+		}
+		if err := recordKeyfile(pwDir, path); err != nil {
+			return nil, err
+		}
+	}
 	return key, nil
 }
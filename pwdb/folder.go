@@ -0,0 +1,18 @@
+package pwdb
+
+import "strings"
+
+// Separator separates the folders in a record name, e.g. "work/aws/root".
+const Separator = "/"
+
+// IsFolder reports whether name refers to a folder rather than a record.
+func IsFolder(name string) bool {
+	return strings.HasSuffix(name, Separator)
+}
+
+func folderPrefix(folder string) string {
+	if folder == "" || IsFolder(folder) {
+		return folder
+	}
+	return folder + Separator
+}
@@ -0,0 +1,94 @@
+package pwdb
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// ForEach calls fn with the current revision of every record in a folder,
+// in name order. Records are decrypted by up to concurrency goroutines at
+// once, or runtime.GOMAXPROCS(0) if concurrency is less than 1, and only a
+// few more than that are held decrypted ahead of fn. fn is called from a
+// single goroutine and must not modify the DB. ForEach stops at the first
+// error.
+func (db *DB) ForEach(folder string, concurrency int, fn func(name string, r *Record) error) error {
+	var envs []*Envelope
+	for _, name := range db.List(folder) {
+		envs = append(envs, db.records[name])
+	}
+	return parallel(envs, concurrency, func(env *Envelope) (interface{}, error) {
+		return db.decrypt(env.Name, env.Data)
+	}, func(env *Envelope, v interface{}, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %q: %v", env.Name, err)
+		}
+		return fn(env.Name, v.(*Record))
+	})
+}
+
+// parallel calls work with each of envs on up to concurrency goroutines, or
+// runtime.GOMAXPROCS(0) if concurrency is less than 1, and done with each
+// result in the order of envs from the calling goroutine. work must not
+// modify the DB, but done may, since the envelopes were taken beforehand.
+// parallel stops at the first error done returns, and returns once no call
+// to work is running.
+func parallel(envs []*Envelope, concurrency int, work func(env *Envelope) (interface{}, error), done func(env *Envelope, v interface{}, err error) error) error {
+	if concurrency < 1 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	type result struct {
+		v   interface{}
+		err error
+	}
+	type job struct {
+		env *Envelope
+		out chan result
+	}
+
+	jobs := make(chan job)
+	// order holds the jobs in flight, in the order done must see them.
+	order := make(chan job, concurrency)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				v, err := work(j.env)
+				j.out <- result{v, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		for _, env := range envs {
+			j := job{env: env, out: make(chan result, 1)}
+			select {
+			case order <- j:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for j := range order {
+		res := <-j.out
+		if err := done(j.env, res.v, res.err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package pwdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	subtleaead "github.com/google/tink/go/subtle/aead"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/google/tink/go/tink"
+)
+
+// benchRecords is the size of the synthetic vault the benchmarks walk.
+const benchRecords = 100000
+
+// benchKeys returns a master key with a single key, a master key that adds a
+// new primary key to it, and the ID of that key.
+func benchKeys(b testing.TB) (old, rotated tink.AEAD, primary uint32) {
+	kek, err := subtleaead.NewXChaCha20Poly1305(random.GetRandomBytes(32))
+	if err != nil {
+		b.Fatal(err)
+	}
+	h, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if old, err = aead.New(h); err != nil {
+		b.Fatal(err)
+	}
+	m := keyset.NewManagerFromHandle(h)
+	if err := m.Rotate(aead.XChaCha20Poly1305KeyTemplate()); err != nil {
+		b.Fatal(err)
+	}
+	if h, err = m.Handle(); err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := h.Write(keyset.NewBinaryWriter(&buf), kek); err != nil {
+		b.Fatal(err)
+	}
+	ks, err := openKeyset(buf.Bytes(), kek)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, rotated, err = sealKeyset(ks, kek); err != nil {
+		b.Fatal(err)
+	}
+	return old, rotated, ks.PrimaryKeyId
+}
+
+// benchDB returns a DB in a temporary directory, which the caller removes,
+// with n records, each with metadata and a revision in its history,
+// encrypted with key.
+func benchDB(b testing.TB, key tink.AEAD, n int) *DB {
+	dir, err := ioutil.TempDir("", "pwdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db := newDB(dir, key)
+	seal := func(name string, r *Record) []byte {
+		p, err := proto.Marshal(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c, err := key.Encrypt(p, []byte(name))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return c
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("folder%d/record%d", i%100, i)
+		r := &Record{
+			Username: fmt.Sprintf("user%d", i),
+			Password: fmt.Sprintf("%x", random.GetRandomBytes(16)),
+			Urls:     []string{fmt.Sprintf("https://example%d.com", i)},
+			Notes:    "recovery codes are in the safe",
+		}
+		m, err := db.sealMetadata(name, r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		prev := proto.Clone(r).(*Record)
+		prev.Password = "old"
+		db.records[name] = &Envelope{
+			Name:     name,
+			Data:     seal(name, r),
+			Metadata: m,
+			History:  []*Revision{{Data: seal(name, prev)}},
+		}
+	}
+	return db
+}
+
+func TestParallel(t *testing.T) {
+	envs := make([]*Envelope, 50)
+	for i := range envs {
+		envs[i] = &Envelope{Name: fmt.Sprint(i)}
+	}
+	errStop := errors.New("stop")
+	for _, tc := range []struct {
+		name        string
+		concurrency int
+		// failWork is the envelope whose work fails, and failDone the one
+		// done fails on, or -1.
+		failWork, failDone int
+		// wantDone is the number of envelopes done is called with.
+		wantDone int
+		wantErr  error
+	}{
+		{"sequential", 1, -1, -1, 50, nil},
+		{"concurrent", 8, -1, -1, 50, nil},
+		{"default concurrency", 0, -1, -1, 50, nil},
+		{"work fails", 8, 10, -1, 11, errStop},
+		{"done fails", 8, -1, 20, 21, errStop},
+		{"first error wins", 4, 30, 5, 6, errStop},
+		{"first envelope fails", 4, 0, -1, 1, errStop},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var started int32
+			var got []string
+			calls := 0
+			err := parallel(envs, tc.concurrency, func(env *Envelope) (interface{}, error) {
+				atomic.AddInt32(&started, 1)
+				i, _ := strconv.Atoi(env.Name)
+				// Finish later envelopes first, so that out of order
+				// results would show.
+				time.Sleep(time.Duration(len(envs)-i) * 50 * time.Microsecond)
+				if i == tc.failWork {
+					return nil, errStop
+				}
+				return i, nil
+			}, func(env *Envelope, v interface{}, err error) error {
+				calls++
+				if err != nil {
+					return err
+				}
+				if v.(int) != len(got) {
+					t.Errorf("done got the result of envelope %d for %q", v, env.Name)
+				}
+				got = append(got, env.Name)
+				if len(got)-1 == tc.failDone {
+					return errStop
+				}
+				return nil
+			})
+			if err != tc.wantErr {
+				t.Fatalf("parallel returned %v, want %v", err, tc.wantErr)
+			}
+			if calls != tc.wantDone {
+				t.Errorf("done was called with %d envelopes, want %d", calls, tc.wantDone)
+			}
+			for i, name := range got {
+				if name != fmt.Sprint(i) {
+					t.Fatalf("done was called with %q in position %d", name, i)
+				}
+			}
+			// After an error, only the envelopes already queued are worked
+			// on: at most one per worker and one per slot of the order
+			// queue, and one held by the feeder. parallel waits for them, so
+			// started is final.
+			concurrency := tc.concurrency
+			if concurrency < 1 {
+				concurrency = runtime.GOMAXPROCS(0)
+			}
+			n, max := int(atomic.LoadInt32(&started)), tc.wantDone+2*concurrency+1
+			if tc.wantErr != nil && n > max {
+				t.Errorf("work started on %d envelopes after an error at %d, want at most %d", n, tc.wantDone-1, max)
+			}
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	key, _, _ := benchKeys(t)
+	db := benchDB(t, key, 100)
+	defer os.RemoveAll(db.dir)
+	var got []string
+	if err := db.ForEach("folder7", 4, func(name string, r *Record) error {
+		got = append(got, name)
+		if want := "user" + strings.TrimPrefix(name, "folder7/record"); r.Username != want {
+			t.Errorf("%q has username %q, want %q", name, r.Username, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := db.List("folder7"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEach visited %q, want %q", got, want)
+	}
+
+	errStop := errors.New("stop")
+	n := 0
+	if err := db.ForEach("", 4, func(name string, r *Record) error {
+		n++
+		if n == 10 {
+			return errStop
+		}
+		return nil
+	}); err != errStop {
+		t.Errorf("ForEach returned %v, want %v", err, errStop)
+	}
+	if n != 10 {
+		t.Errorf("ForEach called fn %d times after it failed on the 10th", n)
+	}
+
+	db.records["folder0/record0"].Data[0] ^= 1
+	n = 0
+	err := db.ForEach("", 4, func(name string, r *Record) error {
+		n++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "folder0/record0") {
+		t.Errorf("ForEach over a corrupt record returned %v, want an error naming it", err)
+	}
+	if n != 0 {
+		t.Errorf("ForEach called fn %d times before the corrupt first record", n)
+	}
+}
+
+func BenchmarkForEach(b *testing.B) {
+	key, _, _ := benchKeys(b)
+	db := benchDB(b, key, benchRecords)
+	defer os.RemoveAll(db.dir)
+	concurrency := []int{1}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		concurrency = append(concurrency, n)
+	}
+	for _, concurrency := range concurrency {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				n := 0
+				if err := db.ForEach("", concurrency, func(name string, r *Record) error {
+					n++
+					return nil
+				}); err != nil {
+					b.Fatal(err)
+				}
+				if n != benchRecords {
+					b.Fatalf("ForEach visited %d records, want %d", n, benchRecords)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFsckCheck(b *testing.B) {
+	key, _, _ := benchKeys(b)
+	db := benchDB(b, key, benchRecords)
+	defer os.RemoveAll(db.dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := &FsckReport{}
+		db.checkRecords(r)
+		if r.Records != benchRecords || len(r.Problems) > 0 {
+			b.Fatalf("checked %d records with problems %q, want %d records and none", r.Records, r.Problems, benchRecords)
+		}
+	}
+}
+
+func BenchmarkCheckDecrypts(b *testing.B) {
+	key, _, _ := benchKeys(b)
+	db := benchDB(b, key, benchRecords)
+	defer os.RemoveAll(db.dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.checkDecrypts(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReencrypt(b *testing.B) {
+	old, rotated, primary := benchKeys(b)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := benchDB(b, old, benchRecords)
+		db.master = rotated
+		b.StartTimer()
+		err := db.reencrypt(primary, func(done, total int) {})
+		os.RemoveAll(db.dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package pwdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mikedanese/pwstore/passwd"
+)
+
+// formatVersion is the on-disk format written by this version of pwdb.
+// Vaults in older formats are upgraded by Migrate.
+const formatVersion = 3
+
+// Every vault file starts with magic, then the length of a Header as a 4
+// byte big endian integer, then the Header. Files written before format
+// version 1 have no header.
+var magic = []byte("pwst")
+
+// vaultFiles are the files whose format is versioned. salt and master only
+// exist before format version 3.
+var vaultFiles = []string{"salt", "master", "slots", "pw.db", "pw.log", "generation"}
+
+// readVaultFile reads a vault file and splits off its header. It returns
+// os.ErrNotExist errors as is.
+func readVaultFile(path string) (*Header, []byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, payload, err := splitHeader(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header of %q: %v", path, err)
+	}
+	return h, payload, nil
+}
+
+// splitHeader splits a vault file into its header and payload. Files without
+// a header have format version 0.
+func splitHeader(b []byte) (*Header, []byte, error) {
+	if !bytes.HasPrefix(b, magic) {
+		return &Header{}, b, nil
+	}
+	b = b[len(magic):]
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("short header")
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(n) > uint64(len(b)) {
+		return nil, nil, fmt.Errorf("short header")
+	}
+	var h Header
+	if err := proto.Unmarshal(b[:n], &h); err != nil {
+		return nil, nil, err
+	}
+	return &h, b[n:], nil
+}
+
+// withHeader prefixes payload with a header.
+func withHeader(h *Header, payload []byte) ([]byte, error) {
+	hb, err := proto.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(hb)))
+	buf.Write(hb)
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// writeVaultFile atomically writes a vault file. The header has the current
+// format version unless it says otherwise.
+func writeVaultFile(path string, h *Header, payload []byte) error {
+	if h == nil {
+		h = &Header{}
+	}
+	if h.FormatVersion == 0 {
+		h.FormatVersion = formatVersion
+	}
+	b, err := withHeader(h, payload)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+// vaultVersion returns the oldest format version of the files in a vault. An
+// empty vault has the current version.
+func vaultVersion(dir string) (int, error) {
+	version := formatVersion
+	for _, name := range vaultFiles {
+		h, _, err := readVaultFile(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		v := int(h.FormatVersion)
+		if v > formatVersion {
+			return 0, fmt.Errorf("%q has format version %d, newer than the supported version %d", name, v, formatVersion)
+		}
+		if v < version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+func checkVersion(dir string) error {
+	v, err := vaultVersion(dir)
+	if err != nil {
+		return err
+	}
+	if v != formatVersion {
+		return fmt.Errorf("vault has format version %d, run \"pwstore migrate\" to upgrade it to version %d", v, formatVersion)
+	}
+	return nil
+}
+
+func kdfFromProto(k *KDF) (passwd.KDFParams, error) {
+	if k == nil || k.Algorithm != KDF_ARGON2ID {
+		return passwd.KDFParams{}, fmt.Errorf("unsupported KDF %v", k)
+	}
+	if k.Threads > math.MaxUint8 {
+		return passwd.KDFParams{}, fmt.Errorf("invalid KDF: %d threads", k.Threads)
+	}
+	p := passwd.KDFParams{
+		Time:    k.Time,
+		Memory:  k.MemoryKib,
+		Threads: uint8(k.Threads),
+	}
+	if err := p.Validate(); err != nil {
+		return passwd.KDFParams{}, fmt.Errorf("invalid KDF: %v", err)
+	}
+	return p, nil
+}
+
+func kdfToProto(p passwd.KDFParams) *KDF {
+	return &KDF{
+		Algorithm: KDF_ARGON2ID,
+		Time:      p.Time,
+		MemoryKib: p.Memory,
+		Threads:   uint32(p.Threads),
+	}
+}
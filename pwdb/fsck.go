@@ -0,0 +1,387 @@
+package pwdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	// Records is the number of records that were checked, including the ones
+	// in the trash.
+	Records int
+	// Problems describes everything that is wrong with the vault.
+	Problems []string
+}
+
+func (r *FsckReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// Fsck checks the selected vault: file modes, leftover temporary files, the
+// record set and its authenticator, that every revision of every record
+// decrypts and parses, and that current attachments decrypt. Unlike Open it
+// reads as much of a damaged vault as it can, and only fails if the vault
+// cannot be unlocked at all.
+func Fsck(opts Options) (*FsckReport, error) {
+	dir, err := opts.Path()
+	if err != nil {
+		return nil, err
+	}
+	r := &FsckReport{}
+	if holder := lockHolder(filepath.Join(dir, "lock")); holder != "" {
+		r.problem("vault is in use by %s", holder)
+	}
+	if err := acquireLock(filepath.Join(dir, "lock"), false, opts); err != nil {
+		return nil, err
+	}
+	checkFiles(dir, r)
+	if err := checkVersion(dir); err != nil {
+		r.problem("%v", err)
+		return r, nil
+	}
+	key, err := unlockMaster(opts, dir)
+	if err != nil {
+		return nil, err
+	}
+	db := newDB(dir, key)
+	db.readOnly = true
+	if db.stateFile, err = opts.generationFile(dir); err != nil {
+		return nil, err
+	}
+	db.scan(r)
+	db.checkRecords(r)
+	return r, nil
+}
+
+// checkRecords checks every record and trash entry, several at a time, and
+// reports their problems in order.
+func (db *DB) checkRecords(r *FsckReport) {
+	var envs []*Envelope
+	for _, name := range db.List("") {
+		envs = append(envs, db.records[name])
+	}
+	for _, e := range db.trash {
+		envs = append(envs, e.Envelope)
+	}
+	parallel(envs, 0, func(env *Envelope) (interface{}, error) {
+		return db.checkEnvelope(env), nil
+	}, func(env *Envelope, v interface{}, err error) error {
+		r.Records++
+		r.Problems = append(r.Problems, v.([]string)...)
+		return nil
+	})
+}
+
+// checkEnvelope returns the problems with the revisions, metadata and
+// current attachments of a record.
+func (db *DB) checkEnvelope(env *Envelope) []string {
+	r := &FsckReport{}
+	name := env.Name
+	if env.Metadata != nil {
+		if _, err := db.openMetadata(name, env.Metadata); err != nil {
+			r.problem("%q: %v", name, err)
+		}
+	}
+	if rec, err := db.decrypt(name, env.Data); err != nil {
+		r.problem("%q: failed to read current revision: %v", name, err)
+	} else {
+		for _, a := range rec.Attachments {
+			if err := db.readAttachment(a.Id, ioutil.Discard); err != nil {
+				r.problem("%q: failed to read attachment %q: %v", name, a.Name, err)
+			}
+		}
+	}
+	for i, rev := range env.History {
+		if _, err := db.decrypt(name, rev.Data); err != nil {
+			r.problem("%q: failed to read revision %d: %v", name, i+1, err)
+		}
+	}
+	return r.Problems
+}
+
+// checkFiles reports vault files that others can access and temporary files
+// left behind by an interrupted write.
+func checkFiles(dir string, r *FsckReport) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		r.problem("%v", err)
+		return
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		r.problem("%q has mode %v, want 0700", dir, fi.Mode().Perm())
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		r.problem("%v", err)
+		return
+	}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			r.problem("%q is left over from an interrupted write", path)
+		}
+		if fi.Name() == restorePending {
+			r.problem("a restore was interrupted and will be finished the next time the vault is opened")
+		}
+		if fi.Name() == keyChangeFile {
+			r.problem("a password change was interrupted; run migrate to finish it")
+		}
+		if fi.Mode().IsRegular() && fi.Mode().Perm()&0077 != 0 {
+			r.problem("%q has mode %v, want 0600", path, fi.Mode().Perm())
+		}
+	}
+}
+
+// scan is a forgiving readState. It loads every record it can read and
+// reports the rest.
+func (db *DB) scan(r *FsckReport) {
+	rs := &RecordSet{}
+	_, b, err := readVaultFile(filepath.Join(db.dir, "pw.db"))
+	if err != nil && !os.IsNotExist(err) {
+		r.problem("%v", err)
+	}
+	if err := proto.Unmarshal(b, rs); err != nil {
+		r.problem("pw.db is damaged: %v", err)
+		rs = salvageRecordSet(b)
+	}
+	if err := db.loadNameKey(rs.NameKey); err != nil {
+		r.problem("%v", err)
+	}
+	for _, env := range rs.Records {
+		env, err := db.openName(env)
+		if err != nil {
+			r.problem("%v", err)
+			continue
+		}
+		db.records[env.Name] = env
+	}
+	for _, e := range rs.Trash {
+		env, err := db.openName(e.Envelope)
+		if err != nil {
+			r.problem("trash: %v", err)
+			continue
+		}
+		db.trash = append(db.trash, &TrashEntry{Envelope: env, DeleteTime: e.DeleteTime})
+	}
+	db.generation = rs.Generation
+	db.retention = time.Duration(rs.TrashRetentionSeconds) * time.Second
+	authenticator := rs.Authenticator
+
+	b, err = ioutil.ReadFile(filepath.Join(db.dir, "pw.log"))
+	if err != nil && !os.IsNotExist(err) {
+		r.problem("%v", err)
+	}
+	_, entries, err := splitHeader(b)
+	if err != nil {
+		r.problem("pw.log: %v", err)
+	}
+	for seq := uint64(0); len(entries) > 0; seq++ {
+		e, n, err := db.readLogEntry(entries, seq)
+		entries = entries[n:]
+		if err != nil {
+			r.problem("pw.log entry %d is damaged: %v", seq, err)
+			continue
+		}
+		if e.Generation != 0 && e.Generation <= db.generation {
+			continue
+		}
+		if err := db.applyLogEntry(e); err != nil {
+			r.problem("pw.log entry %d: %v", seq, err)
+			continue
+		}
+		authenticator = e.Authenticator
+	}
+
+	if db.generation > 0 {
+		if err := db.verify(authenticator); err != nil {
+			r.problem("%v", err)
+		}
+	}
+	if err := db.checkGeneration(); err != nil {
+		r.problem("%v", err)
+	}
+}
+
+// salvageRecordSet decodes the fields of a damaged RecordSet one at a time,
+// keeping every one that parses and stopping where the data ends or makes
+// no sense.
+func salvageRecordSet(b []byte) *RecordSet {
+	rs := &RecordSet{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+		b = b[n:]
+		field, wire := key>>3, key&7
+		if wire == 0 {
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				break
+			}
+			b = b[n:]
+			switch field {
+			case 3:
+				rs.Generation = v
+			case 6:
+				rs.TrashRetentionSeconds = int64(v)
+			}
+			continue
+		}
+		if wire != 2 {
+			break
+		}
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)-n) {
+			break
+		}
+		v := b[n : n+int(l)]
+		b = b[n+int(l):]
+		switch field {
+		case 1:
+			var env Envelope
+			if proto.Unmarshal(v, &env) == nil {
+				rs.Records = append(rs.Records, &env)
+			}
+		case 2:
+			var e TrashEntry
+			if proto.Unmarshal(v, &e) == nil && e.Envelope != nil {
+				rs.Trash = append(rs.Trash, &e)
+			}
+		case 4:
+			rs.Authenticator = v
+		case 5:
+			rs.NameKey = v
+		}
+	}
+	return rs
+}
+
+// Salvage copies every record of the selected vault whose current revision
+// can be read into a new vault named to, which has the same key slots, along
+// with the attachments they reference. Unreadable earlier revisions are
+// dropped. It returns the number of records copied.
+func Salvage(opts Options, to string) (int, error) {
+	// We want the permissions we specify to be respected.
+	syscall.Umask(0)
+
+	dir, err := opts.Path()
+	if err != nil {
+		return 0, err
+	}
+	if err := acquireLock(filepath.Join(dir, "lock"), false, opts); err != nil {
+		return 0, err
+	}
+	if err := checkVersion(dir); err != nil {
+		return 0, err
+	}
+	key, err := unlockMaster(opts, dir)
+	if err != nil {
+		return 0, err
+	}
+	src := newDB(dir, key)
+	src.readOnly = true
+	src.scan(&FsckReport{})
+
+	if err := CreateVault(opts, to); err != nil {
+		return 0, err
+	}
+	o := opts
+	o.Vault = to
+	toDir, err := o.Path()
+	if err != nil {
+		return 0, err
+	}
+	if err := acquireLock(filepath.Join(toDir, "lock"), true, opts); err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, slotsFile))
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFile(filepath.Join(toDir, slotsFile), b); err != nil {
+		return 0, err
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, keyfilePathFile)); err == nil {
+		if err := writeFile(filepath.Join(toDir, keyfilePathFile), b); err != nil {
+			return 0, err
+		}
+	}
+
+	db := newDB(toDir, key)
+	if db.stateFile, err = o.generationFile(toDir); err != nil {
+		return 0, err
+	}
+	db.nameKey = src.nameKey
+	db.retention = src.retention
+	attachments := map[string]bool{}
+	keep := func(env *Envelope) *Envelope {
+		r, err := src.decrypt(env.Name, env.Data)
+		if err != nil {
+			return nil
+		}
+		for _, a := range r.Attachments {
+			attachments[a.Id] = true
+		}
+		out := &Envelope{Name: env.Name, Data: env.Data, UpdateTime: env.UpdateTime}
+		if _, err := src.openMetadata(env.Name, env.Metadata); err == nil {
+			out.Metadata = env.Metadata
+		}
+		for _, rev := range env.History {
+			r, err := src.decrypt(env.Name, rev.Data)
+			if err != nil {
+				continue
+			}
+			for _, a := range r.Attachments {
+				attachments[a.Id] = true
+			}
+			out.History = append(out.History, rev)
+		}
+		return out
+	}
+	for _, env := range src.records {
+		if env := keep(env); env != nil {
+			db.records[env.Name] = env
+		}
+	}
+	for _, e := range src.trash {
+		if env := keep(e.Envelope); env != nil {
+			db.trash = append(db.trash, &TrashEntry{Envelope: env, DeleteTime: e.DeleteTime})
+		}
+	}
+	if err := salvageAttachments(dir, toDir, attachments); err != nil {
+		return 0, err
+	}
+	return len(db.records), db.Compact()
+}
+
+// salvageAttachments copies the attachment files with the given IDs that
+// exist in the vault in from to the vault in to.
+func salvageAttachments(from, to string, ids map[string]bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	dir := filepath.Join(to, "attachments")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for id := range ids {
+		if validAttachmentID(id) != nil {
+			continue
+		}
+		err := linkFile(filepath.Join(from, "attachments", id), filepath.Join(dir, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
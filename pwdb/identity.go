@@ -0,0 +1,102 @@
+package pwdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A public key slot lets another user unlock a vault with their own key
+// instead of a shared secret. The user makes an identity file with
+// CreateIdentity, which holds an X25519 private key, and hands out its
+// public key, which slots add seals the vault key to. The identity file is
+// the only secret: the slot holds no private key, so it cannot be opened, or
+// its secret changed, by anyone else.
+
+// identity returns the path of the identity file selected by o: Identity,
+// then $PWSTORE_IDENTITY. It returns "" if there is none.
+func (o Options) identity() string {
+	if o.Identity != "" {
+		return o.Identity
+	}
+	return os.Getenv("PWSTORE_IDENTITY")
+}
+
+// CreateIdentity writes a new identity file to path, which must not exist,
+// and returns its public key as ParsePublicKey takes it.
+func CreateIdentity(path string) (string, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write([]byte(base64.StdEncoding.EncodeToString(priv[:]) + "\n")); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub[:]), nil
+}
+
+// readIdentity returns the private and public keys of an identity file.
+func readIdentity(path string) (priv, pub *[32]byte, _ error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read identity: %v", err)
+	}
+	k, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(k) != 32 {
+		return nil, nil, fmt.Errorf("%q is not an identity file", path)
+	}
+	priv, pub = new([32]byte), new([32]byte)
+	copy(priv[:], k)
+	curve25519.ScalarBaseMult(pub, priv)
+	return priv, pub, nil
+}
+
+// ParsePublicKey parses the public key of an identity, as CreateIdentity
+// returns it.
+func ParsePublicKey(s string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(k) != 32 {
+		return nil, fmt.Errorf("invalid public key %q", s)
+	}
+	return k, nil
+}
+
+// unlockIdentity opens the vault key in the public key slot of ss that the
+// identity file at path matches.
+func unlockIdentity(ss *SlotSet, path string) (*unlocked, []byte, error) {
+	priv, pub, err := readIdentity(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range ss.Slots {
+		if s.Type != Slot_PUBLIC_KEY || !bytes.Equal(s.PublicKey, pub[:]) {
+			continue
+		}
+		if vaultKey, ok := openVaultKey(s, priv); ok {
+			return &unlocked{slot: s}, vaultKey, nil
+		}
+		return nil, nil, fmt.Errorf("slot %d is corrupt", s.Id)
+	}
+	return nil, nil, fmt.Errorf("vault has no slot for identity %q", path)
+}
@@ -0,0 +1,147 @@
+package pwdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/tink/go/subtle/random"
+)
+
+// A password slot may need a keyfile as well as its password, and a keyfile
+// slot needs a keyfile alone. The SHA-256 of the keyfile is appended to the
+// password before the key that wraps the vault key is derived from it, and
+// the slot records an HMAC of that hash so that a wrong keyfile is told apart
+// from a wrong password before the password is asked for. Any file works as
+// a keyfile, but CreateKeyfile makes one from random bytes.
+
+// keyfilePathFile holds the path of the keyfile of a vault, so that it does
+// not have to be given every time.
+const keyfilePathFile = "keyfile.path"
+
+// keyfileSize is the number of random bytes CreateKeyfile writes.
+const keyfileSize = 64
+
+// keyfile returns the path of the keyfile selected by o: Keyfile, then
+// $PWSTORE_KEYFILE, then the path recorded in the vault. It returns "" if
+// there is none.
+func (o Options) keyfile() (string, error) {
+	if o.Keyfile != "" {
+		return o.Keyfile, nil
+	}
+	if path := os.Getenv("PWSTORE_KEYFILE"); path != "" {
+		return path, nil
+	}
+	dir, err := o.Path()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, keyfilePathFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// hashKeyfile returns the SHA-256 of the contents of a keyfile.
+func hashKeyfile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %v", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %v", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("keyfile %q is empty", path)
+	}
+	return h.Sum(nil), nil
+}
+
+func keyfileCheck(salt, hash []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte("keyfile"))
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+// CreateKeyfile writes a new keyfile of random bytes to path, which must not
+// exist.
+func CreateKeyfile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(random.GetRandomBytes(keyfileSize)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// SetKeyfile prompts for the password of the selected vault and wraps the
+// vault key in the password slot that was unlocked with a key derived from
+// the password, the keyfile at path and a fresh salt, and records the path
+// in the vault. If path is empty, the slot no longer needs a keyfile.
+func SetKeyfile(opts Options, path string) error {
+	dir, ss, err := lockSlots(opts)
+	if err != nil {
+		return err
+	}
+	var keyfile []byte
+	if path != "" {
+		if path, err = filepath.Abs(path); err != nil {
+			return err
+		}
+		if keyfile, err = hashKeyfile(path); err != nil {
+			return err
+		}
+	}
+	u, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return err
+	}
+	if u.slot.Type != Slot_PASSWORD {
+		return fmt.Errorf("slot %d is not a password slot", u.slot.Id)
+	}
+	if err := sealSlot(u.slot, u.secret, keyfile, vaultKey); err != nil {
+		return err
+	}
+	if err := writeSlots(dir, ss); err != nil {
+		return err
+	}
+	if err := removeBackupKeys(dir); err != nil {
+		return err
+	}
+	return recordKeyfile(dir, path)
+}
+
+// recordKeyfile records the path of the keyfile of the vault in dir, or
+// removes the record if path is empty.
+func recordKeyfile(dir, path string) error {
+	if path == "" {
+		if err := os.Remove(filepath.Join(dir, keyfilePathFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFile(filepath.Join(dir, keyfilePathFile), []byte(path+"\n"))
+}
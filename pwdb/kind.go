@@ -0,0 +1,202 @@
+package pwdb
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// Kinds are the names of the kinds of record, as returned by Kind.
+var Kinds = []string{"login", "note", "card", "ssh-key", "api-token", "identity"}
+
+// Kind returns the name of the kind of r.
+func Kind(r *Record) string {
+	switch r.Kind.(type) {
+	case *Record_SecureNote:
+		return "note"
+	case *Record_CreditCard:
+		return "card"
+	case *Record_SshKey:
+		return "ssh-key"
+	case *Record_ApiToken:
+		return "api-token"
+	case *Record_Identity:
+		return "identity"
+	}
+	return "login"
+}
+
+// summary describes r in a line without revealing any secrets, e.g. the
+// last digits and expiry of a card.
+func summary(r *Record) string {
+	switch k := r.Kind.(type) {
+	case *Record_CreditCard:
+		c := k.CreditCard
+		s := "card"
+		if n := cardDigits(c.Number); len(n) >= 4 {
+			s += " ending " + n[len(n)-4:]
+		}
+		if c.ExpiryYear != 0 {
+			s += fmt.Sprintf(" expires %02d/%d", c.ExpiryMonth, c.ExpiryYear)
+		}
+		return s
+	case *Record_SshKey:
+		f := strings.Fields(k.SshKey.PublicKey)
+		if len(f) == 0 {
+			return "ssh key"
+		}
+		return strings.Join(append(f[:1:1], f[2:]...), " ")
+	case *Record_ApiToken:
+		t := k.ApiToken
+		if t.ExpireTime == nil {
+			return "token"
+		}
+		exp, _ := ptypes.Timestamp(t.ExpireTime)
+		return "token expires " + exp.Local().Format("2006-01-02")
+	case *Record_Identity:
+		return k.Identity.FullName
+	case *Record_SecureNote:
+		return ""
+	}
+	return r.Username
+}
+
+// expireTime returns when r expires if it is a card or token with an
+// expiry, and the zero time otherwise.
+func expireTime(r *Record) time.Time {
+	switch k := r.Kind.(type) {
+	case *Record_CreditCard:
+		c := k.CreditCard
+		if c.ExpiryYear == 0 {
+			return time.Time{}
+		}
+		// A card is valid until the end of its expiry month.
+		return time.Date(int(c.ExpiryYear), time.Month(c.ExpiryMonth)+1, 1, 0, 0, 0, 0, time.Local)
+	case *Record_ApiToken:
+		if k.ApiToken.ExpireTime == nil {
+			return time.Time{}
+		}
+		t, _ := ptypes.Timestamp(k.ApiToken.ExpireTime)
+		return t
+	}
+	return time.Time{}
+}
+
+// Expired reports whether the record described by m is a card or token
+// whose expiry has passed.
+func Expired(m *Metadata, now time.Time) bool {
+	if m.ExpireTime == nil {
+		return false
+	}
+	t, err := ptypes.Timestamp(m.ExpireTime)
+	return err == nil && !now.Before(t)
+}
+
+// checkKind validates the payload of a typed record.
+func checkKind(r *Record) error {
+	switch k := r.Kind.(type) {
+	case *Record_CreditCard:
+		return checkCard(k.CreditCard)
+	case *Record_SshKey:
+		return checkSSHKey(k.SshKey)
+	case *Record_ApiToken:
+		if k.ApiToken.Token == "" {
+			return fmt.Errorf("api token is empty")
+		}
+		if t := k.ApiToken.ExpireTime; t != nil {
+			if _, err := ptypes.Timestamp(t); err != nil {
+				return fmt.Errorf("invalid api token expiry: %v", err)
+			}
+		}
+	case *Record_Identity:
+		if e := k.Identity.Email; e != "" {
+			if _, err := mail.ParseAddress(e); err != nil {
+				return fmt.Errorf("invalid email %q: %v", e, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cardDigits strips the spaces and dashes that card numbers are often
+// written with.
+func cardDigits(number string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(number)
+}
+
+func checkCard(c *CreditCard) error {
+	n := cardDigits(c.Number)
+	if len(n) < 12 || len(n) > 19 {
+		return fmt.Errorf("card number has %d digits, want 12 to 19", len(n))
+	}
+	// Luhn checksum.
+	sum := 0
+	for i := range n {
+		d := int(n[len(n)-1-i] - '0')
+		if d < 0 || d > 9 {
+			return fmt.Errorf("card number contains %q", n[len(n)-1-i])
+		}
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	if sum%10 != 0 {
+		return fmt.Errorf("card number fails its checksum")
+	}
+	if c.ExpiryMonth == 0 && c.ExpiryYear == 0 {
+		return nil
+	}
+	if c.ExpiryMonth < 1 || c.ExpiryMonth > 12 {
+		return fmt.Errorf("invalid card expiry month %d", c.ExpiryMonth)
+	}
+	if c.ExpiryYear < 1000 {
+		return fmt.Errorf("invalid card expiry year %d, want four digits", c.ExpiryYear)
+	}
+	return nil
+}
+
+func checkSSHKey(k *SSHKey) error {
+	block, rest := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("ssh private key is not PEM encoded")
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return fmt.Errorf("ssh private key has trailing data")
+	}
+	// OpenSSH keys, and keys encrypted with a passphrase, can only be
+	// checked for PEM framing.
+	if block.Headers["Proc-Type"] == "" {
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			_, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			_, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			_, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid ssh private key: %v", err)
+		}
+	}
+	if k.PublicKey != "" {
+		f := strings.Fields(k.PublicKey)
+		if len(f) < 2 {
+			return fmt.Errorf("ssh public key is not in authorized_keys format")
+		}
+		if _, err := base64.StdEncoding.DecodeString(f[1]); err != nil {
+			return fmt.Errorf("invalid ssh public key: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package pwdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPollInterval is how often a blocked lock is retried.
+const lockPollInterval = 50 * time.Millisecond
+
+// acquireLock takes a shared or exclusive flock on path, retrying until
+// opts.LockTimeout has passed. The lock is held until the process exits.
+func acquireLock(path string, exclusive bool, opts Options) error {
+	fd, err := unix.Open(path, unix.O_CREAT|unix.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	deadline := time.Now().Add(opts.LockTimeout)
+	for {
+		err := unix.Flock(fd, how|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK || !time.Now().Before(deadline) {
+			unix.Close(fd)
+			if holder := lockHolder(path); holder != "" {
+				return fmt.Errorf("failed to acquire DB lock held by %s: %v", holder, err)
+			}
+			return fmt.Errorf("failed to acquire DB lock: %v", err)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Record who holds the lock so that anyone waiting on it can say so.
+	return recordHolder(fd, exclusive, opts.Command)
+}
+
+// recordHolder rewrites the lock file to hold a record of this process and,
+// unless it holds the lock exclusively, of the other live holders. A record
+// is the PID, the program name and command, never the arguments, which may
+// name records. Records of processes that are gone are dropped, so the file
+// does not grow. Shared holders may do this at the same time, so it is done
+// under a POSIX record lock, which is separate from the flock.
+func recordHolder(fd int, exclusive bool, command string) error {
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	if err := unix.FcntlFlock(uintptr(fd), unix.F_SETLKW, &lk); err != nil {
+		return err
+	}
+	defer func() {
+		lk.Type = unix.F_UNLCK
+		unix.FcntlFlock(uintptr(fd), unix.F_SETLK, &lk)
+	}()
+	var keep []string
+	if !exclusive {
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			return err
+		}
+		b := make([]byte, st.Size)
+		n, err := unix.Pread(fd, b, 0)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(b[:n]), "\n") {
+			if _, _, ok := liveHolder(line); ok {
+				keep = append(keep, line+"\n")
+			}
+		}
+	}
+	holder := filepath.Base(os.Args[0])
+	if command != "" {
+		holder += " " + command
+	}
+	keep = append(keep, fmt.Sprintf("%d %s\n", os.Getpid(), holder))
+	if err := unix.Ftruncate(fd, 0); err != nil {
+		return err
+	}
+	_, err := unix.Pwrite(fd, []byte(strings.Join(keep, "")), 0)
+	return err
+}
+
+// liveHolder parses a record of a lock file. It reports false if the record
+// is damaged or its process is this one or gone.
+func liveHolder(line string) (pid int, cmd string, ok bool) {
+	fields := strings.SplitN(line, " ", 2)
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return 0, "", false
+	}
+	if err := unix.Kill(pid, 0); err == unix.ESRCH {
+		return 0, "", false
+	}
+	if len(fields) == 2 {
+		cmd = fields[1]
+	}
+	return pid, cmd, true
+}
+
+// lockHolder describes the live processes recorded in a lock file, or
+// returns "" if they are all gone.
+func lockHolder(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var holders []string
+	for _, line := range strings.Split(string(b), "\n") {
+		pid, cmd, ok := liveHolder(line)
+		if !ok {
+			continue
+		}
+		if cmd == "" {
+			holders = append(holders, fmt.Sprintf("pid %d", pid))
+		} else {
+			holders = append(holders, fmt.Sprintf("pid %d (%s)", pid, cmd))
+		}
+	}
+	return strings.Join(holders, ", ")
+}
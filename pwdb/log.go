@@ -0,0 +1,193 @@
+package pwdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// DefaultCompactThreshold is the default size of pw.log above which it is
+// compacted into pw.db.
+const DefaultCompactThreshold = 1 << 20
+
+// pw.log is a vault file header followed by a sequence of entries, each a 4
+// byte big endian length followed by a LogEntry encrypted with the master
+// key. The position of the entry in the log is bound to it as associated
+// data, so entries cannot be reordered or dropped from the middle of the
+// log.
+
+// errTornEntry is returned by readLogEntry for an entry that does not fit in
+// what is left of the log, as left by a crash during appendLog.
+var errTornEntry = errors.New("torn entry")
+
+func logAD(seq uint64) []byte {
+	return []byte(fmt.Sprintf("pw.log/%d", seq))
+}
+
+func (db *DB) appendLog(e *LogEntry) error {
+	b, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+	c, err := db.master.Encrypt(b, logAD(db.logSeq))
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(c))
+	binary.BigEndian.PutUint32(frame, uint32(len(c)))
+	copy(frame[4:], c)
+	if db.logSize == 0 {
+		h, err := withHeader(&Header{FormatVersion: formatVersion}, nil)
+		if err != nil {
+			return err
+		}
+		frame = append(h, frame...)
+	}
+
+	logPath := filepath.Join(db.dir, "pw.log")
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(frame); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if db.logSize == 0 {
+		// The log was just created.
+		if err := syncDir(db.dir); err != nil {
+			return err
+		}
+	}
+	db.logSeq++
+	db.logSize += int64(len(frame))
+	return nil
+}
+
+// replayLog applies every entry in pw.log to the records loaded from the
+// snapshot, and calls applied with each entry. Entries that are already part
+// of the snapshot are skipped. A torn entry at the end of the log, left by a
+// crash during appendLog, is ignored and left for load to truncate once the
+// state has been verified. A complete entry that does not decrypt was
+// committed, so it is reported as corrupt wherever it is.
+func (db *DB) replayLog(applied func(*LogEntry)) error {
+	logPath := filepath.Join(db.dir, "pw.log")
+	b, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_, entries, err := splitHeader(b)
+	if err != nil {
+		return fmt.Errorf("failed to read header of %q: %v", logPath, err)
+	}
+	// off is the offset of the next entry in the file.
+	off := len(b) - len(entries)
+	for off < len(b) {
+		e, n, err := db.readLogEntry(b[off:], db.logSeq)
+		if err != nil {
+			if err != errTornEntry {
+				return fmt.Errorf("pw.log entry %d is corrupt: %v", db.logSeq, err)
+			}
+			db.logTorn = true
+			break
+		}
+		// Entries written before format version 2 have no generation.
+		if e.Generation == 0 || e.Generation > db.generation {
+			if err := db.applyLogEntry(e); err != nil {
+				return fmt.Errorf("failed to apply pw.log entry %d: %v", db.logSeq, err)
+			}
+			applied(e)
+		}
+		db.logSeq++
+		off += n
+	}
+	db.logSize = int64(off)
+	return nil
+}
+
+// truncateLog removes the torn entry that replayLog found at the end of
+// pw.log, so that the next entry is appended after the last complete one.
+func (db *DB) truncateLog() error {
+	if err := os.Truncate(filepath.Join(db.dir, "pw.log"), db.logSize); err != nil {
+		return err
+	}
+	db.logTorn = false
+	return nil
+}
+
+// readLogEntry decodes the entry at the start of b and returns it along with
+// its length. If the entry does not fit in b, it returns errTornEntry and the
+// length of b.
+func (db *DB) readLogEntry(b []byte, seq uint64) (*LogEntry, int, error) {
+	if len(b) < 4 {
+		return nil, len(b), errTornEntry
+	}
+	n := 4 + int(binary.BigEndian.Uint32(b))
+	if n > len(b) {
+		return nil, len(b), errTornEntry
+	}
+	pt, err := db.master.Decrypt(b[4:n], logAD(seq))
+	if err != nil {
+		return nil, n, err
+	}
+	var e LogEntry
+	if err := proto.Unmarshal(pt, &e); err != nil {
+		return nil, n, err
+	}
+	return &e, n, nil
+}
+
+func (db *DB) applyLogEntry(e *LogEntry) error {
+	for _, env := range e.Put {
+		env, err := db.openName(env)
+		if err != nil {
+			return err
+		}
+		db.records[env.Name] = env
+	}
+	for _, name := range e.Delete {
+		delete(db.records, name)
+	}
+	for _, c := range e.EncryptedDelete {
+		name, err := db.master.Decrypt(c, deleteAD)
+		if err != nil {
+			return err
+		}
+		delete(db.records, string(name))
+	}
+	if e.TrashChanged {
+		trash, err := db.openTrash(e.Trash)
+		if err != nil {
+			return err
+		}
+		db.trash = trash
+	}
+	if e.RetentionChanged {
+		db.retention = time.Duration(e.TrashRetentionSeconds) * time.Second
+	}
+	db.generation = e.Generation
+	return nil
+}
+
+func (db *DB) removeLog() error {
+	if err := os.Remove(filepath.Join(db.dir, "pw.log")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db.logSeq = 0
+	db.logSize = 0
+	db.logTorn = false
+	return syncDir(db.dir)
+}
@@ -0,0 +1,93 @@
+package pwdb
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// Every Envelope carries the Metadata of its current revision, encrypted
+// separately from its data. Together they form an index of the vault that
+// list and search read without decrypting any secrets. Since the metadata is
+// part of the Envelope, it is written, replayed and authenticated with it
+// and cannot fall out of sync.
+
+func metadataAD(name string) []byte {
+	return []byte("metadata/" + name)
+}
+
+// newMetadata returns the parts of r that are not secret.
+func newMetadata(r *Record) *Metadata {
+	m := &Metadata{
+		Username:   r.Username,
+		Urls:       r.Urls,
+		Tags:       r.Tags,
+		CreateTime: r.CreateTime,
+		UpdateTime: r.UpdateTime,
+		Kind:       Kind(r),
+		Summary:    summary(r),
+	}
+	if t := expireTime(r); !t.IsZero() {
+		m.ExpireTime, _ = ptypes.TimestampProto(t)
+	}
+	return m
+}
+
+func (db *DB) sealMetadata(name string, r *Record) ([]byte, error) {
+	b, err := proto.Marshal(newMetadata(r))
+	if err != nil {
+		return nil, err
+	}
+	return db.master.Encrypt(b, metadataAD(name))
+}
+
+// Metadata returns the metadata of the current revision of a record. Only
+// records written before metadata existed are decrypted to find it.
+func (db *DB) Metadata(name string) (*Metadata, error) {
+	env, ok := db.records[name]
+	if !ok {
+		return nil, fmt.Errorf("password %q not found", name)
+	}
+	if env.Metadata == nil {
+		r, err := db.decrypt(name, env.Data)
+		if err != nil {
+			return nil, err
+		}
+		return newMetadata(r), nil
+	}
+	return db.openMetadata(name, env.Metadata)
+}
+
+func (db *DB) openMetadata(name string, c []byte) (*Metadata, error) {
+	b, err := db.master.Decrypt(c, metadataAD(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt metadata of %q: %v", name, err)
+	}
+	var m Metadata
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// addMissingMetadata adds metadata to the records written before it
+// existed. Records that cannot be read are left as they are.
+func (db *DB) addMissingMetadata() {
+	for name, env := range db.records {
+		if env.Metadata != nil {
+			continue
+		}
+		r, err := db.decrypt(name, env.Data)
+		if err != nil {
+			continue
+		}
+		c, err := db.sealMetadata(name, r)
+		if err != nil {
+			continue
+		}
+		env = proto.Clone(env).(*Envelope)
+		env.Metadata = c
+		db.records[name] = env
+	}
+}
@@ -0,0 +1,295 @@
+package pwdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	subtleaead "github.com/google/tink/go/subtle/aead"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/google/tink/go/tink"
+	"github.com/mikedanese/pwstore/passwd"
+)
+
+// A migration upgrades a vault from one format version to the next. It must
+// be safe to run again on a vault where it was interrupted. Once it
+// succeeds, the headers of all files are set to the next version.
+type migration struct {
+	from int
+	desc string
+	run  func(m *migrator) error
+}
+
+// migrations are indexed by the version they upgrade from.
+var migrations = []migration{
+	{from: 0, desc: "add format headers", run: addHeaders},
+	{from: 1, desc: "authenticate the record set", run: authenticate},
+	{from: 2, desc: "move the master keyset into a key slot", run: addSlots},
+}
+
+// migrator holds the state shared by the migrations of one Migrate call.
+type migrator struct {
+	opts   Options
+	dir    string
+	master tink.AEAD
+
+	// legacy is the password slot described by the salt file of a vault
+	// from before key slots, handle its master keyset and wrap the key
+	// derived for legacy that wraps it.
+	legacy *Slot
+	handle *keyset.Handle
+	wrap   tink.AEAD
+}
+
+// key returns the master key. The password is only asked for if a migration
+// needs it, and only once.
+func (m *migrator) key() (tink.AEAD, error) {
+	if m.master != nil {
+		return m.master, nil
+	}
+	if _, err := os.Stat(filepath.Join(m.dir, "salt")); err != nil {
+		key, err := loadMasterAEAD(m.opts, m.dir)
+		if err != nil {
+			return nil, err
+		}
+		m.master = key
+		return key, nil
+	}
+	if err := m.unlockLegacy(); err != nil {
+		return nil, err
+	}
+	key, err := aead.New(m.handle)
+	if err != nil {
+		return nil, err
+	}
+	m.master = key
+	return key, nil
+}
+
+// unlockLegacy unlocks the master keyset of a vault from before key slots,
+// which is wrapped directly with the key derived from the password.
+func (m *migrator) unlockLegacy() error {
+	if m.handle != nil {
+		return nil
+	}
+	h, salt, err := readVaultFile(filepath.Join(m.dir, "salt"))
+	if err != nil {
+		return err
+	}
+	_, masterb, err := readVaultFile(filepath.Join(m.dir, "master"))
+	if err != nil {
+		return err
+	}
+	s := &Slot{Type: Slot_PASSWORD, Kdf: h.Kdf, Salt: salt, KeyfileCheck: h.KeyfileCheck}
+	if _, err := unlockSlots(m.opts, []*Slot{s}, func(_ *Slot, key tink.AEAD) bool {
+		kh, err := keyset.Read(keyset.NewBinaryReader(bytes.NewReader(masterb)), key)
+		if err != nil {
+			return false
+		}
+		m.handle, m.wrap = kh, key
+		return true
+	}); err != nil {
+		return err
+	}
+	m.legacy = s
+	return nil
+}
+
+// Migrate upgrades the selected vault to the current format version. The
+// vault files are copied to a backup directory first, whose path is
+// returned. If the vault is up to date, Migrate does nothing and returns "".
+func Migrate(opts Options) (string, error) {
+	// We want the permissions we specify to be respected.
+	syscall.Umask(0)
+
+	dir, err := opts.Path()
+	if err != nil {
+		return "", err
+	}
+	if err := acquireLock(filepath.Join(dir, "lock"), true, opts); err != nil {
+		return "", err
+	}
+	if err := finishRestore(dir); err != nil {
+		return "", err
+	}
+	if err := finishKeyChange(dir); err != nil {
+		return "", err
+	}
+	v, err := vaultVersion(dir)
+	if err != nil {
+		return "", err
+	}
+	if v == formatVersion {
+		return "", nil
+	}
+	backup, err := backupVault(dir, fmt.Sprintf("migrate-v%d-%s", v, time.Now().Format("20060102T150405")), vaultFiles)
+	if err != nil {
+		return "", fmt.Errorf("failed to back up vault: %v", err)
+	}
+	m := &migrator{opts: opts, dir: dir}
+	for ; v < formatVersion; v++ {
+		mig := migrations[v]
+		if err := mig.run(m); err != nil {
+			return backup, fmt.Errorf("failed to %s: %v", mig.desc, err)
+		}
+		if err := setVersion(dir, v+1); err != nil {
+			return backup, err
+		}
+	}
+	return backup, nil
+}
+
+// setVersion sets the format version in the header of every vault file that
+// is older than version.
+func setVersion(dir string, version int) error {
+	for _, name := range vaultFiles {
+		path := filepath.Join(dir, name)
+		h, payload, err := readVaultFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if int(h.FormatVersion) >= version {
+			continue
+		}
+		h.FormatVersion = uint32(version)
+		if err := writeVaultFile(path, h, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addHeaders records the KDF parameters in the salt file. Version 0 vaults
+// always used the default parameters. The headers themselves are added by
+// setVersion.
+func addHeaders(m *migrator) error {
+	path := filepath.Join(m.dir, "salt")
+	h, salt, err := readVaultFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if h.Kdf != nil {
+		return nil
+	}
+	h.FormatVersion = 1
+	h.Kdf = kdfToProto(passwd.DefaultKDFParams)
+	return writeVaultFile(path, h, salt)
+}
+
+// authenticate compacts the vault into a snapshot with a generation and an
+// authenticator.
+func authenticate(m *migrator) error {
+	key, err := m.key()
+	if err != nil {
+		return err
+	}
+	db := newDB(m.dir, key)
+	if _, err := db.readState(); err != nil {
+		return err
+	}
+	return db.Compact()
+}
+
+// addSlots moves the master keyset into the slots file, encrypted with a new
+// vault key, and adds a password slot that wraps the vault key with the key
+// that wrapped the master keyset. The password, salt, KDF parameters and any
+// keyfile of the vault stay the same.
+func addSlots(m *migrator) error {
+	saltPath := filepath.Join(m.dir, "salt")
+	masterPath := filepath.Join(m.dir, "master")
+	if _, err := os.Stat(saltPath); os.IsNotExist(err) {
+		// The slots were written and the salt file removed.
+		if err := os.Remove(masterPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := m.unlockLegacy(); err != nil {
+		return err
+	}
+	vaultKey := random.GetRandomBytes(vaultKeySize)
+	kek, err := subtleaead.NewXChaCha20Poly1305(vaultKey)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := m.handle.Write(keyset.NewBinaryWriter(&buf), kek); err != nil {
+		return err
+	}
+	s := proto.Clone(m.legacy).(*Slot)
+	s.Id = 1
+	s.Name = "password"
+	s.CreateTime = ptypes.TimestampNow()
+	if err := newSlotKeyPair(s, m.wrap); err != nil {
+		return err
+	}
+	if err := sealVaultKey(s, vaultKey); err != nil {
+		return err
+	}
+	if err := writeSlots(m.dir, &SlotSet{Slots: []*Slot{s}, Master: buf.Bytes()}); err != nil {
+		return err
+	}
+	if err := os.Remove(saltPath); err != nil {
+		return err
+	}
+	if err := os.Remove(masterPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(m.dir)
+}
+
+// Before format version 3, the key that wraps the master keyset was derived
+// with the parameters and salt in the salt file, and the master file held
+// the wrapped keyset. The two files must always match, but cannot be
+// replaced atomically. A password change therefore first wrote both new
+// files into keyChangeFile, which committed the change, then replaced salt
+// and master and removed keyChangeFile. Migrate finishes such a change
+// before anything else.
+const keyChangeFile = "keys.pending"
+
+func readKeyChange(dir string) (*KeyChange, error) {
+	_, b, err := readVaultFile(filepath.Join(dir, keyChangeFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var kc KeyChange
+	if err := proto.Unmarshal(b, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", keyChangeFile, err)
+	}
+	return &kc, nil
+}
+
+// finishKeyChange completes a committed password change, if there is one.
+// The vault must be locked exclusively.
+func finishKeyChange(dir string) error {
+	kc, err := readKeyChange(dir)
+	if kc == nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, "salt"), kc.Salt); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, "master"), kc.Master); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, keyChangeFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
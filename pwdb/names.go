@@ -0,0 +1,125 @@
+package pwdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/google/tink/go/subtle/random"
+)
+
+// When names are encrypted, pw.db and pw.log only hold an HMAC of each name,
+// which serves as a blind index, and the name encrypted with the master key.
+// Names are decrypted when the vault is loaded, so in memory every Envelope
+// has its plaintext name.
+
+var (
+	nameKeyAD = []byte("pw.db/name key")
+	deleteAD  = []byte("pw.log/delete")
+)
+
+// NamesEncrypted reports whether record names are encrypted on disk.
+func (db *DB) NamesEncrypted() bool {
+	return db.nameKey != nil
+}
+
+// EncryptNames encrypts the names of all records, and of every record added
+// later. The vault is compacted and its backups are removed so that no
+// plaintext names are left in it.
+func (db *DB) EncryptNames() error {
+	if db.nameKey != nil {
+		return nil
+	}
+	if db.readOnly {
+		return errReadOnly
+	}
+	db.nameKey = random.GetRandomBytes(32)
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	return removeBackups(db.dir)
+}
+
+func (db *DB) blindIndex(name string) string {
+	m := hmac.New(sha256.New, db.nameKey)
+	m.Write([]byte(name))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// sealName returns env as it is stored on disk.
+func (db *DB) sealName(env *Envelope) (*Envelope, error) {
+	if db.nameKey == nil {
+		return env, nil
+	}
+	idx := db.blindIndex(env.Name)
+	c, err := db.master.Encrypt([]byte(env.Name), []byte(idx))
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Name:          idx,
+		EncryptedName: c,
+		Data:          env.Data,
+		UpdateTime:    env.UpdateTime,
+		History:       env.History,
+		Metadata:      env.Metadata,
+	}, nil
+}
+
+// openName returns env with its name decrypted.
+func (db *DB) openName(env *Envelope) (*Envelope, error) {
+	if len(env.EncryptedName) == 0 {
+		return env, nil
+	}
+	name, err := db.master.Decrypt(env.EncryptedName, []byte(env.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt name of record %s: %v", env.Name, err)
+	}
+	return &Envelope{
+		Name:       string(name),
+		Data:       env.Data,
+		UpdateTime: env.UpdateTime,
+		History:    env.History,
+		Metadata:   env.Metadata,
+	}, nil
+}
+
+func (db *DB) sealTrash(trash []*TrashEntry) ([]*TrashEntry, error) {
+	if db.nameKey == nil {
+		return trash, nil
+	}
+	var out []*TrashEntry
+	for _, e := range trash {
+		env, err := db.sealName(e.Envelope)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &TrashEntry{Envelope: env, DeleteTime: e.DeleteTime})
+	}
+	return out, nil
+}
+
+func (db *DB) openTrash(trash []*TrashEntry) ([]*TrashEntry, error) {
+	var out []*TrashEntry
+	for _, e := range trash {
+		env, err := db.openName(e.Envelope)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &TrashEntry{Envelope: env, DeleteTime: e.DeleteTime})
+	}
+	return out, nil
+}
+
+func (db *DB) loadNameKey(c []byte) error {
+	if len(c) == 0 {
+		return nil
+	}
+	key, err := db.master.Decrypt(c, nameKeyAD)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt name key: %v", err)
+	}
+	db.nameKey = key
+	return nil
+}
@@ -0,0 +1,78 @@
+package pwdb
+
+import (
+	"fmt"
+
+	"github.com/mikedanese/pwstore/passwd"
+)
+
+// ChangePassword prompts for the current password of the selected vault and
+// then a new one, and wraps the vault key in the password slot that was
+// unlocked with a key derived from the new password and a fresh salt. A
+// keyfile the slot needs is still needed. No record is re-encrypted, and
+// copies of the old slots in backups are removed.
+func ChangePassword(opts Options) error {
+	dir, ss, err := lockSlots(opts)
+	if err != nil {
+		return err
+	}
+	u, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return err
+	}
+	if u.slot.Type != Slot_PASSWORD {
+		return fmt.Errorf("slot %d is not a password slot; use slots add to add a password", u.slot.Id)
+	}
+	pw, err := passwd.ReadNewPassword()
+	if err != nil {
+		return fmt.Errorf("failed to read new password: %v", err)
+	}
+	if err := sealSlot(u.slot, pw, u.keyfile, vaultKey); err != nil {
+		return err
+	}
+	if err := writeSlots(dir, ss); err != nil {
+		return err
+	}
+	return removeBackupKeys(dir)
+}
+
+// SetKDF prompts for the password of the selected vault and wraps the vault
+// key in the slot that was unlocked with a key derived with the KDF
+// parameters p and a fresh salt. Zero fields of p keep their current value.
+func SetKDF(opts Options, p passwd.KDFParams) error {
+	dir, ss, err := lockSlots(opts)
+	if err != nil {
+		return err
+	}
+	u, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return err
+	}
+	if u.slot.Type == Slot_PUBLIC_KEY {
+		return fmt.Errorf("slot %d is a public key slot, which has no KDF", u.slot.Id)
+	}
+	kdf, err := kdfFromProto(u.slot.Kdf)
+	if err != nil {
+		return err
+	}
+	if p.Time == 0 {
+		p.Time = kdf.Time
+	}
+	if p.Memory == 0 {
+		p.Memory = kdf.Memory
+	}
+	if p.Threads == 0 {
+		p.Threads = kdf.Threads
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	u.slot.Kdf = kdfToProto(p)
+	if err := sealSlot(u.slot, u.secret, u.keyfile, vaultKey); err != nil {
+		return err
+	}
+	if err := writeSlots(dir, ss); err != nil {
+		return err
+	}
+	return removeBackupKeys(dir)
+}
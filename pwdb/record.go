@@ -0,0 +1,133 @@
+package pwdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// builtinFields are the Record fields that Lookup finds by name. Custom
+// fields cannot use these names.
+var builtinFields = map[string]func(r *Record) string{
+	"username": func(r *Record) string { return r.Username },
+	"password": func(r *Record) string { return r.Password },
+	"notes":    func(r *Record) string { return r.Notes },
+}
+
+// Lookup returns the value of the field of r with a name. Besides custom
+// fields it finds username, password and notes.
+func Lookup(r *Record, name string) (string, bool) {
+	if get, ok := builtinFields[name]; ok {
+		return get(r), true
+	}
+	for _, f := range r.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+const mask = "********"
+
+// Redact returns a copy of r with the values of hidden fields and the
+// secrets of typed records masked.
+func Redact(r *Record) *Record {
+	r = proto.Clone(r).(*Record)
+	for _, f := range r.Fields {
+		if f.Hidden {
+			f.Value = mask
+		}
+	}
+	switch k := r.Kind.(type) {
+	case *Record_CreditCard:
+		if n := cardDigits(k.CreditCard.Number); len(n) > 4 {
+			k.CreditCard.Number = mask + n[len(n)-4:]
+		}
+		if k.CreditCard.Cvv != "" {
+			k.CreditCard.Cvv = mask
+		}
+	case *Record_SshKey:
+		if k.SshKey.PrivateKey != "" {
+			k.SshKey.PrivateKey = mask
+		}
+		if k.SshKey.Passphrase != "" {
+			k.SshKey.Passphrase = mask
+		}
+	case *Record_ApiToken:
+		if k.ApiToken.Token != "" {
+			k.ApiToken.Token = mask
+		}
+	}
+	return r
+}
+
+// checkRedacted fails if a secret of r holds a value masked by Redact, so
+// that a redacted record that is put back does not overwrite the secrets.
+func checkRedacted(r *Record) error {
+	var masked []string
+	for _, f := range r.Fields {
+		if f.Hidden && f.Value == mask {
+			masked = append(masked, f.Name)
+		}
+	}
+	switch k := r.Kind.(type) {
+	case *Record_CreditCard:
+		if strings.HasPrefix(k.CreditCard.Number, mask) {
+			masked = append(masked, "credit_card.number")
+		}
+		if k.CreditCard.Cvv == mask {
+			masked = append(masked, "credit_card.cvv")
+		}
+	case *Record_SshKey:
+		if k.SshKey.PrivateKey == mask {
+			masked = append(masked, "ssh_key.private_key")
+		}
+		if k.SshKey.Passphrase == mask {
+			masked = append(masked, "ssh_key.passphrase")
+		}
+	case *Record_ApiToken:
+		if k.ApiToken.Token == mask {
+			masked = append(masked, "api_token.token")
+		}
+	}
+	if len(masked) > 0 {
+		return fmt.Errorf("%s: masked values cannot be put back, get the record with --reveal to edit it", strings.Join(masked, ", "))
+	}
+	return nil
+}
+
+// checkRecord checks that r holds no masked secrets, that its custom fields
+// have distinct names that do not shadow a built-in field, that its
+// attachments have distinct names and valid IDs, and validates its typed
+// payload.
+func checkRecord(r *Record) error {
+	if err := checkRedacted(r); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i, f := range r.Fields {
+		if f.Name == "" {
+			return fmt.Errorf("field %d has no name", i+1)
+		}
+		if _, ok := builtinFields[f.Name]; ok {
+			return fmt.Errorf("field %q is reserved", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("field %q is set more than once", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	attached := map[string]bool{}
+	for _, a := range r.Attachments {
+		if attached[a.Name] {
+			return fmt.Errorf("attachment %q is set more than once", a.Name)
+		}
+		attached[a.Name] = true
+		if err := validAttachmentID(a.Id); err != nil {
+			return err
+		}
+	}
+	return checkKind(r)
+}
@@ -0,0 +1,407 @@
+package pwdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/core/cryptofmt"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	tinkpb "github.com/google/tink/proto/tink_go_proto"
+)
+
+// A rekey adds a new primary key to the master keyset and re-encrypts the
+// vault under it. The keys it replaces stay in the keyset, enabled, until
+// nothing is encrypted with them any more. They are then disabled, and only
+// destroyed once the vault has been read back without them. Records are
+// re-encrypted in batches, each committed like any other change, and a
+// rekey that is interrupted resumes where it stopped: the presence of keys
+// other than the primary that are not yet destroyed is what marks a rekey in
+// progress.
+
+// rekeyBatch is the number of records re-encrypted per commit.
+const rekeyBatch = 256
+
+// Rekey unlocks the selected vault, rotates its master key and re-encrypts
+// every record, revision, trash entry and attachment under the new key.
+// progress, if not nil, is called as the work advances.
+func Rekey(opts Options, progress func(done, total int)) error {
+	if progress == nil {
+		progress = func(int, int) {}
+	}
+	dir, ss, err := lockSlots(opts)
+	if err != nil {
+		return err
+	}
+	_, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return err
+	}
+	h, kek, err := openMaster(ss, vaultKey)
+	if err != nil {
+		return err
+	}
+	ks, err := openKeyset(ss.Master, kek)
+	if err != nil {
+		return err
+	}
+	writeKeyset := func() (tink.AEAD, error) {
+		b, master, err := sealKeyset(ks, kek)
+		if err != nil {
+			return nil, err
+		}
+		ss.Master = b
+		if err := writeSlots(dir, ss); err != nil {
+			return nil, fmt.Errorf("failed to write master keyset: %v", err)
+		}
+		return master, nil
+	}
+
+	if len(retiredKeys(ks)) == 0 {
+		m := keyset.NewManagerFromHandle(h)
+		if err := m.Rotate(aead.XChaCha20Poly1305KeyTemplate()); err != nil {
+			return fmt.Errorf("failed to add master key: %v", err)
+		}
+		if h, err = m.Handle(); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := h.Write(keyset.NewBinaryWriter(&buf), kek); err != nil {
+			return fmt.Errorf("failed to wrap master keyset: %v", err)
+		}
+		if ks, err = openKeyset(buf.Bytes(), kek); err != nil {
+			return err
+		}
+	}
+	// A rekey that failed after disabling the old keys needs them again.
+	for _, k := range retiredKeys(ks) {
+		k.Status = tinkpb.KeyStatusType_ENABLED
+	}
+	master, err := writeKeyset()
+	if err != nil {
+		return err
+	}
+
+	db, err := openWithKey(opts, dir, master, false)
+	if err != nil {
+		return err
+	}
+	if err := db.reencrypt(ks.PrimaryKeyId, progress); err != nil {
+		return err
+	}
+
+	for _, k := range retiredKeys(ks) {
+		k.Status = tinkpb.KeyStatusType_DISABLED
+	}
+	if master, err = writeKeyset(); err != nil {
+		return err
+	}
+	db, err = openWithKey(opts, dir, master, true)
+	if err == nil {
+		err = db.checkDecrypts()
+	}
+	if err != nil {
+		return fmt.Errorf("vault is not readable without the old master key, which is disabled but kept; run rekey again to retry: %v", err)
+	}
+	if err := removeBackups(dir); err != nil {
+		return fmt.Errorf("failed to remove backups encrypted with the old master key: %v", err)
+	}
+
+	for _, k := range retiredKeys(ks) {
+		k.Status = tinkpb.KeyStatusType_DESTROYED
+		k.KeyData = &tinkpb.KeyData{
+			TypeUrl:         k.KeyData.TypeUrl,
+			KeyMaterialType: k.KeyData.KeyMaterialType,
+		}
+	}
+	_, err = writeKeyset()
+	return err
+}
+
+// retiredKeys returns the keys of ks that are neither the primary key nor
+// destroyed.
+func retiredKeys(ks *tinkpb.Keyset) []*tinkpb.Keyset_Key {
+	var out []*tinkpb.Keyset_Key
+	for _, k := range ks.Key {
+		if k.KeyId != ks.PrimaryKeyId && k.Status != tinkpb.KeyStatusType_DESTROYED {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// openKeyset decrypts an encrypted master keyset with the vault key.
+func openKeyset(masterb []byte, kek tink.AEAD) (*tinkpb.Keyset, error) {
+	var ek tinkpb.EncryptedKeyset
+	if err := proto.Unmarshal(masterb, &ek); err != nil {
+		return nil, fmt.Errorf("failed to parse master keyset: %v", err)
+	}
+	b, err := kek.Decrypt(ek.EncryptedKeyset, []byte{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt master keyset: %v", err)
+	}
+	var ks tinkpb.Keyset
+	if err := proto.Unmarshal(b, &ks); err != nil {
+		return nil, fmt.Errorf("failed to parse master keyset: %v", err)
+	}
+	return &ks, nil
+}
+
+// sealKeyset returns ks encrypted with the vault key, and an AEAD for the
+// enabled keys of ks.
+func sealKeyset(ks *tinkpb.Keyset, kek tink.AEAD) ([]byte, tink.AEAD, error) {
+	if err := keyset.Validate(ks); err != nil {
+		return nil, nil, fmt.Errorf("invalid master keyset: %v", err)
+	}
+	b, err := proto.Marshal(ks)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := kek.Encrypt(b, []byte{})
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := keyset.Read(&keyset.MemReaderWriter{EncryptedKeyset: &tinkpb.EncryptedKeyset{EncryptedKeyset: c}}, kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	if err := h.Write(keyset.NewBinaryWriter(&buf), kek); err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap master keyset: %v", err)
+	}
+	master, err := aead.New(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), master, nil
+}
+
+// encryptedWith reports whether c was encrypted with the key keyID.
+func encryptedWith(c []byte, keyID uint32) bool {
+	return len(c) >= cryptofmt.TinkPrefixSize &&
+		c[0] == cryptofmt.TinkStartByte &&
+		binary.BigEndian.Uint32(c[1:cryptofmt.TinkPrefixSize]) == keyID
+}
+
+// reencrypt re-encrypts everything in the vault that is not encrypted with
+// the key keyID, which must be the primary key of db.master.
+func (db *DB) reencrypt(keyID uint32, progress func(done, total int)) error {
+	names := db.List("")
+	fis, err := ioutil.ReadDir(db.attachmentDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var ids []string
+	for _, fi := range fis {
+		if validAttachmentID(fi.Name()) == nil {
+			ids = append(ids, fi.Name())
+		}
+	}
+	total := len(names) + len(db.trash) + len(ids)
+	done := 0
+	progress(done, total)
+
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > rekeyBatch {
+			batch = batch[:rekeyBatch]
+		}
+		names = names[len(batch):]
+		var envs []*Envelope
+		for _, name := range batch {
+			envs = append(envs, db.records[name])
+		}
+		if err := db.Update(func(tx *Tx) error {
+			return parallel(envs, 0, func(env *Envelope) (interface{}, error) {
+				return db.rekeyEnvelope(env, keyID)
+			}, func(_ *Envelope, v interface{}, err error) error {
+				if env := v.(*Envelope); err == nil && env != nil {
+					db.putEnvelope(env)
+				}
+				return err
+			})
+		}); err != nil {
+			return err
+		}
+		done += len(batch)
+		progress(done, total)
+	}
+
+	var trashed []*Envelope
+	for _, e := range db.trash {
+		trashed = append(trashed, e.Envelope)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		i := 0
+		return parallel(trashed, 0, func(env *Envelope) (interface{}, error) {
+			return db.rekeyEnvelope(env, keyID)
+		}, func(_ *Envelope, v interface{}, err error) error {
+			if env := v.(*Envelope); err == nil && env != nil {
+				db.trash[i] = &TrashEntry{Envelope: env, DeleteTime: db.trash[i].DeleteTime}
+				db.trashDirty = true
+			}
+			i++
+			return err
+		})
+	}); err != nil {
+		return err
+	}
+	done += len(db.trash)
+	progress(done, total)
+
+	// Compact rewrites the name key, the authenticator and the generation
+	// under the new key, drops the log written under the old one, and
+	// deletes the attachments nothing refers to.
+	if err := db.Compact(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := db.rekeyAttachment(id, keyID); err != nil {
+			return err
+		}
+		done++
+		progress(done, total)
+	}
+	return nil
+}
+
+// rekeyEnvelope returns a copy of env with every revision and its metadata
+// encrypted with the key keyID, or nil if they already are.
+func (db *DB) rekeyEnvelope(env *Envelope, keyID uint32) (*Envelope, error) {
+	changed := false
+	rekey := func(c, ad []byte) ([]byte, error) {
+		if encryptedWith(c, keyID) {
+			return c, nil
+		}
+		b, err := db.master.Decrypt(c, ad)
+		if err != nil {
+			return nil, err
+		}
+		changed = true
+		return db.master.Encrypt(b, ad)
+	}
+	out := proto.Clone(env).(*Envelope)
+	var err error
+	if out.Data, err = rekey(env.Data, []byte(env.Name)); err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt %q: %v", env.Name, err)
+	}
+	if env.Metadata != nil {
+		if out.Metadata, err = rekey(env.Metadata, metadataAD(env.Name)); err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt metadata of %q: %v", env.Name, err)
+		}
+	}
+	for i, rev := range out.History {
+		if rev.Data, err = rekey(rev.Data, []byte(env.Name)); err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt revision %d of %q: %v", i+1, env.Name, err)
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// rekeyAttachment re-encrypts an attachment file with the key keyID, unless
+// it is already encrypted with it or was deleted. The file is replaced
+// atomically.
+func (db *DB) rekeyAttachment(id string, keyID uint32) error {
+	ok, err := db.attachmentEncryptedWith(id, keyID)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || ok {
+		return err
+	}
+	// A temporary file may be left over from an interrupted rekey.
+	if err := os.Remove(filepath.Join(db.attachmentDir(), id+".tmp")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.readAttachment(id, pw))
+	}()
+	_, err = db.writeAttachmentFile(id, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt attachment %s: %v", id, err)
+	}
+	return nil
+}
+
+// attachmentEncryptedWith reports whether an attachment file is encrypted
+// with the key keyID. All of its chunks are encrypted with the same key, so
+// only the first one is looked at.
+func (db *DB) attachmentEncryptedWith(id string, keyID uint32) (bool, error) {
+	f, err := os.Open(filepath.Join(db.attachmentDir(), id))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if err := readHeader(r); err != nil {
+		return false, fmt.Errorf("attachment %s: %v", id, err)
+	}
+	var frame [5 + cryptofmt.TinkPrefixSize]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return false, fmt.Errorf("attachment %s is truncated", id)
+	}
+	return encryptedWith(frame[5:], keyID), nil
+}
+
+// checkDecrypts checks that every revision, metadata and attachment in the
+// vault can be decrypted.
+func (db *DB) checkDecrypts() error {
+	check := func(env *Envelope) error {
+		revs := append([]*Revision{{Data: env.Data}}, env.History...)
+		for i, rev := range revs {
+			if _, err := db.decrypt(env.Name, rev.Data); err != nil {
+				return fmt.Errorf("failed to decrypt revision %d of %q: %v", i, env.Name, err)
+			}
+		}
+		if env.Metadata != nil {
+			if _, err := db.openMetadata(env.Name, env.Metadata); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var envs []*Envelope
+	for _, name := range db.List("") {
+		envs = append(envs, db.records[name])
+	}
+	for _, e := range db.trash {
+		envs = append(envs, e.Envelope)
+	}
+	if err := parallel(envs, 0, func(env *Envelope) (interface{}, error) {
+		return nil, check(env)
+	}, func(env *Envelope, v interface{}, err error) error {
+		return err
+	}); err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(db.attachmentDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		if validAttachmentID(fi.Name()) != nil {
+			continue
+		}
+		if err := db.readAttachment(fi.Name(), ioutil.Discard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
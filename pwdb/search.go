@@ -0,0 +1,152 @@
+package pwdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Query matches records against a set of terms, all of which must match. A
+// term is either a bare pattern, which matches any field in the metadata,
+// or a pattern qualified with a field, such as user:alice. The name, user,
+// urls, tags and type of a record are in its metadata. The notes and custom
+// fields are only in the record itself, which is decrypted only for a note
+// or field term, so that other searches never load a secret. Passwords and
+// the secrets of typed records are never searched, nor are the values of
+// hidden fields.
+type Query struct {
+	terms []term
+}
+
+type term struct {
+	field string
+	match func(string) bool
+}
+
+// indexFields returns the searchable values of each field in the metadata
+// of a record.
+var indexFields = map[string]func(name string, m *Metadata) []string{
+	"name": func(name string, m *Metadata) []string { return []string{name} },
+	"user": func(name string, m *Metadata) []string { return []string{m.Username} },
+	"url":  func(name string, m *Metadata) []string { return m.Urls },
+	"tag":  func(name string, m *Metadata) []string { return m.Tags },
+	"type": func(name string, m *Metadata) []string { return []string{m.Kind} },
+}
+
+// recordFields returns the searchable values of the fields that are only in
+// the record.
+var recordFields = map[string]func(r *Record) []string{
+	"note": func(r *Record) []string { return []string{r.Notes} },
+	"field": func(r *Record) []string {
+		var out []string
+		for _, f := range r.Fields {
+			out = append(out, f.Name)
+			if !f.Hidden {
+				out = append(out, f.Value)
+			}
+		}
+		return out
+	},
+}
+
+// fieldAliases are other names accepted for a qualifier.
+var fieldAliases = map[string]string{
+	"username": "user",
+	"notes":    "note",
+	"tags":     "tag",
+	"urls":     "url",
+	"kind":     "type",
+}
+
+// ParseQuery parses a query. Patterns are case insensitive substrings, or
+// regular expressions if regex is set. A term whose prefix is not a known
+// field, such as https://example.com, is a bare pattern.
+func ParseQuery(s string, regex bool) (*Query, error) {
+	q := &Query{}
+	for _, t := range strings.Fields(s) {
+		var field string
+		if i := strings.Index(t, ":"); i > 0 {
+			f := strings.ToLower(t[:i])
+			if alias, ok := fieldAliases[f]; ok {
+				f = alias
+			}
+			_, index := indexFields[f]
+			_, record := recordFields[f]
+			if index || record {
+				field, t = f, t[i+1:]
+			}
+		}
+		match, err := matcher(t, regex)
+		if err != nil {
+			return nil, err
+		}
+		q.terms = append(q.terms, term{field: field, match: match})
+	}
+	return q, nil
+}
+
+func matcher(pattern string, regex bool) (func(string) bool, error) {
+	if !regex {
+		pattern = strings.ToLower(pattern)
+		return func(s string) bool {
+			return strings.Contains(strings.ToLower(s), pattern)
+		}, nil
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return re.MatchString, nil
+}
+
+// Match reports whether a record matches every term of q. get returns the
+// record, and is only called, at most once, if a note or field term searches
+// the record itself and every metadata term matched.
+func (q *Query) Match(name string, m *Metadata, get func() (*Record, error)) (bool, error) {
+	var r *Record
+	record := func() (*Record, error) {
+		if r != nil {
+			return r, nil
+		}
+		var err error
+		r, err = get()
+		return r, err
+	}
+	for _, inRecord := range []bool{false, true} {
+		for _, t := range q.terms {
+			if _, ok := recordFields[t.field]; ok != inRecord {
+				continue
+			}
+			ok, err := t.matches(name, m, record)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+func (t term) matches(name string, m *Metadata, record func() (*Record, error)) (bool, error) {
+	if f, ok := recordFields[t.field]; ok {
+		r, err := record()
+		if err != nil {
+			return false, err
+		}
+		return t.matchAny(f(r)), nil
+	}
+	for field, f := range indexFields {
+		if (t.field == "" || t.field == field) && t.matchAny(f(name, m)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t term) matchAny(values []string) bool {
+	for _, v := range values {
+		if t.match(v) {
+			return true
+		}
+	}
+	return false
+}
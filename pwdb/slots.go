@@ -0,0 +1,539 @@
+package pwdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	subtleaead "github.com/google/tink/go/subtle/aead"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/google/tink/go/tink"
+	tinkpb "github.com/google/tink/proto/tink_go_proto"
+	"github.com/mikedanese/pwstore/passwd"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// The master keyset of a vault is encrypted with a random vault key. The
+// slots file holds the encrypted keyset and a list of key slots, each of
+// which has an X25519 key pair and a copy of the vault key sealed to its
+// public key. The private key is encrypted with a key derived from the
+// secret of the slot: a password, optionally with a keyfile, a recovery
+// code, or a keyfile alone. A public key slot has no private key; it belongs
+// to another user's identity file. Any slot unlocks the vault, and changing the
+// secret of one slot, or the master keyset itself, leaves the others as they
+// are. Since sealing needs only the public keys, removing a slot replaces
+// the vault key for all the others, so that a copy of the vault key taken
+// through the removed slot no longer opens the master keyset.
+//
+// To unlock a vault, the public key slot of the selected identity file, if
+// any, is opened. Otherwise the slots that the selected keyfile, if any,
+// matches are tried first; a keyfile slot opens without a password. Otherwise one
+// password is asked for and tried against every password and recovery code
+// slot that does not need a keyfile it was not given.
+
+const slotsFile = "slots"
+
+// vaultKeySize is the size of the vault key, an XChaCha20-Poly1305 key.
+const vaultKeySize = 32
+
+// recoveryCodeSize is the number of random bytes in a recovery code.
+const recoveryCodeSize = 20
+
+// SlotTypes are the names of the slot types, as AddSlot takes them.
+var SlotTypes = map[string]Slot_Type{
+	"password":   Slot_PASSWORD,
+	"recovery":   Slot_RECOVERY_CODE,
+	"keyfile":    Slot_KEYFILE,
+	"public-key": Slot_PUBLIC_KEY,
+}
+
+func slotAD(id uint32) []byte {
+	return []byte(fmt.Sprintf("slot/%d", id))
+}
+
+// KDFParams returns the parameters of the KDF that derives the key of s.
+func (s *Slot) KDFParams() (passwd.KDFParams, error) {
+	return kdfFromProto(s.Kdf)
+}
+
+// readSlots reads the slots file of the vault in dir. It returns
+// os.ErrNotExist errors as is.
+func readSlots(dir string) (*SlotSet, error) {
+	path := filepath.Join(dir, slotsFile)
+	_, b, err := readVaultFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ss SlotSet
+	if err := proto.Unmarshal(b, &ss); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", path, err)
+	}
+	if len(ss.Slots) == 0 {
+		return nil, fmt.Errorf("%q has no key slots", path)
+	}
+	return &ss, nil
+}
+
+func writeSlots(dir string, ss *SlotSet) error {
+	b, err := proto.Marshal(ss)
+	if err != nil {
+		return err
+	}
+	return writeVaultFile(filepath.Join(dir, slotsFile), nil, b)
+}
+
+// newSlotSet returns the slots of a new vault: a new master keyset and a
+// password slot for pw and the hash of a keyfile, which may be nil.
+func newSlotSet(pw, keyfile []byte) (*SlotSet, tink.AEAD, error) {
+	vaultKey := random.GetRandomBytes(vaultKeySize)
+	kek, err := subtleaead.NewXChaCha20Poly1305(vaultKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	if err := h.Write(keyset.NewBinaryWriter(&buf), kek); err != nil {
+		return nil, nil, fmt.Errorf("failed to write initial master keyset: %v", err)
+	}
+	s := &Slot{
+		Id:         1,
+		Name:       "password",
+		Type:       Slot_PASSWORD,
+		Kdf:        kdfToProto(passwd.DefaultKDFParams),
+		CreateTime: ptypes.TimestampNow(),
+	}
+	if err := sealSlot(s, pw, keyfile, vaultKey); err != nil {
+		return nil, nil, err
+	}
+	master, err := aead.New(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &SlotSet{Slots: []*Slot{s}, Master: buf.Bytes()}, master, nil
+}
+
+// openMaster decrypts the master keyset of ss with the vault key.
+func openMaster(ss *SlotSet, vaultKey []byte) (*keyset.Handle, tink.AEAD, error) {
+	kek, err := subtleaead.NewXChaCha20Poly1305(vaultKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := keyset.Read(keyset.NewBinaryReader(bytes.NewReader(ss.Master)), kek)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt master keyset: %v", err)
+	}
+	return h, kek, nil
+}
+
+// deriveSlotKey derives the key that wraps the vault key in s from a secret
+// and the hash of a keyfile, which is nil unless s needs one.
+func deriveSlotKey(s *Slot, secret, keyfile []byte) (tink.AEAD, error) {
+	kdf, err := kdfFromProto(s.Kdf)
+	if err != nil {
+		return nil, err
+	}
+	if s.Type == Slot_RECOVERY_CODE {
+		secret = normalizeRecoveryCode(secret)
+	}
+	if keyfile != nil {
+		secret = append(append([]byte(nil), secret...), keyfile...)
+	}
+	return passwd.DeriveKey(secret, s.Salt, kdf)
+}
+
+// sealSlot gives s a new key pair, whose private key is encrypted with a key
+// derived from secret, the hash of a keyfile, which may be nil, and a fresh
+// salt, and seals the vault key to it.
+func sealSlot(s *Slot, secret, keyfile, vaultKey []byte) error {
+	s.Salt = random.GetRandomBytes(16)
+	s.KeyfileCheck = nil
+	if keyfile != nil {
+		s.KeyfileCheck = keyfileCheck(s.Salt, keyfile)
+	}
+	key, err := deriveSlotKey(s, secret, keyfile)
+	if err != nil {
+		return err
+	}
+	if err := newSlotKeyPair(s, key); err != nil {
+		return err
+	}
+	return sealVaultKey(s, vaultKey)
+}
+
+// newSlotKeyPair gives s a new X25519 key pair, with the private key
+// encrypted with key.
+func newSlotKeyPair(s *Slot, key tink.AEAD) error {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	s.PublicKey = pub[:]
+	s.PrivateKey, err = key.Encrypt(priv[:], slotAD(s.Id))
+	return err
+}
+
+// sealVaultKey seals the vault key to the public key of s with an ephemeral
+// key pair.
+func sealVaultKey(s *Slot, vaultKey []byte) error {
+	var pub [32]byte
+	if len(s.PublicKey) != len(pub) {
+		return fmt.Errorf("slot %d has no valid public key", s.Id)
+	}
+	copy(pub[:], s.PublicKey)
+	ephemeral, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+	s.Key = box.Seal(append(ephemeral[:], nonce[:]...), vaultKey, &nonce, &pub, priv)
+	return nil
+}
+
+// openSlot returns the vault key in s if key, derived for s, decrypts its
+// private key.
+func openSlot(s *Slot, key tink.AEAD) ([]byte, bool) {
+	b, err := key.Decrypt(s.PrivateKey, slotAD(s.Id))
+	if err != nil || len(b) != 32 {
+		return nil, false
+	}
+	var priv [32]byte
+	copy(priv[:], b)
+	return openVaultKey(s, &priv)
+}
+
+// openVaultKey opens the vault key sealed in s with its private key.
+func openVaultKey(s *Slot, priv *[32]byte) ([]byte, bool) {
+	var ephemeral [32]byte
+	var nonce [24]byte
+	if len(s.Key) < len(ephemeral)+len(nonce) {
+		return nil, false
+	}
+	copy(ephemeral[:], s.Key)
+	copy(nonce[:], s.Key[len(ephemeral):])
+	return box.Open(nil, s.Key[len(ephemeral)+len(nonce):], &nonce, &ephemeral, priv)
+}
+
+// rotateVaultKey wraps the master keyset ks with a new vault key, and seals
+// the new vault key to every slot of ss.
+func rotateVaultKey(ss *SlotSet, ks *tinkpb.Keyset) error {
+	vaultKey := random.GetRandomBytes(vaultKeySize)
+	kek, err := subtleaead.NewXChaCha20Poly1305(vaultKey)
+	if err != nil {
+		return err
+	}
+	if ss.Master, _, err = sealKeyset(ks, kek); err != nil {
+		return err
+	}
+	for _, s := range ss.Slots {
+		if err := sealVaultKey(s, vaultKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlocked is a slot opened by unlockSlots, with the secrets that opened it.
+type unlocked struct {
+	slot    *Slot
+	secret  []byte
+	keyfile []byte
+}
+
+// unlockSlots finds a slot that the keyfile selected by opts and, unless it
+// is a keyfile slot, a password prompted for open, where open reports whether
+// a key derived for a slot is the right one. Errors say which secret is
+// wrong.
+func unlockSlots(opts Options, slots []*Slot, open func(s *Slot, key tink.AEAD) bool) (*unlocked, error) {
+	path, err := opts.keyfile()
+	if err != nil {
+		return nil, err
+	}
+	var hash []byte
+	if path != "" {
+		if hash, err = hashKeyfile(path); err != nil {
+			return nil, err
+		}
+	}
+	useKeyfile := false
+	var candidates []*Slot
+	for _, s := range slots {
+		if s.Type == Slot_PUBLIC_KEY {
+			continue
+		}
+		if len(s.KeyfileCheck) == 0 {
+			if s.Type != Slot_KEYFILE {
+				candidates = append(candidates, s)
+			}
+			continue
+		}
+		useKeyfile = true
+		if hash == nil || !hmac.Equal(keyfileCheck(s.Salt, hash), s.KeyfileCheck) {
+			continue
+		}
+		if s.Type == Slot_KEYFILE {
+			key, err := deriveSlotKey(s, nil, hash)
+			if err != nil {
+				return nil, err
+			}
+			if open(s, key) {
+				return &unlocked{slot: s, keyfile: hash}, nil
+			}
+			continue
+		}
+		// Slots that match the keyfile go first.
+		candidates = append([]*Slot{s}, candidates...)
+	}
+	if opts.Keyfile != "" && !useKeyfile {
+		return nil, errors.New("vault does not use a keyfile")
+	}
+	if len(candidates) == 0 {
+		if !useKeyfile {
+			return nil, errors.New("vault only has public key slots, pass --identity or set $PWSTORE_IDENTITY")
+		}
+		if hash == nil {
+			return nil, errors.New("vault needs a keyfile, pass --keyfile or set $PWSTORE_KEYFILE")
+		}
+		return nil, fmt.Errorf("wrong keyfile %q", path)
+	}
+
+	pw, err := passwd.ReadPassword()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %v", err)
+	}
+	for _, s := range candidates {
+		var keyfile []byte
+		if len(s.KeyfileCheck) > 0 {
+			keyfile = hash
+		}
+		key, err := deriveSlotKey(s, pw, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		if open(s, key) {
+			return &unlocked{slot: s, secret: pw, keyfile: keyfile}, nil
+		}
+	}
+	return nil, errors.New("wrong password")
+}
+
+// unlock unlocks a slot of ss and returns it and the vault key.
+func unlock(opts Options, ss *SlotSet) (*unlocked, []byte, error) {
+	if path := opts.identity(); path != "" {
+		return unlockIdentity(ss, path)
+	}
+	var vaultKey []byte
+	u, err := unlockSlots(opts, ss.Slots, func(s *Slot, key tink.AEAD) bool {
+		b, ok := openSlot(s, key)
+		if ok {
+			vaultKey = b
+		}
+		return ok
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, vaultKey, nil
+}
+
+// lockSlots locks the selected vault exclusively for a change of its keys and
+// returns its directory and slots.
+func lockSlots(opts Options) (string, *SlotSet, error) {
+	// We want the permissions we specify to be respected.
+	syscall.Umask(0)
+
+	dir, err := opts.Path()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := acquireLock(filepath.Join(dir, "lock"), true, opts); err != nil {
+		return "", nil, err
+	}
+	if err := finishRestore(dir); err != nil {
+		return "", nil, err
+	}
+	if err := checkVersion(dir); err != nil {
+		return "", nil, err
+	}
+	ss, err := readSlots(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, errors.New("vault has no key slots")
+		}
+		return "", nil, err
+	}
+	return dir, ss, nil
+}
+
+// Slots returns the key slots of the selected vault. The vault is not
+// unlocked.
+func Slots(opts Options) ([]*Slot, error) {
+	dir, err := opts.Path()
+	if err != nil {
+		return nil, err
+	}
+	if err := acquireLock(filepath.Join(dir, "lock"), false, opts); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(dir); err != nil {
+		return nil, err
+	}
+	ss, err := readSlots(dir)
+	if err != nil {
+		return nil, err
+	}
+	return ss.Slots, nil
+}
+
+// AddSlot unlocks the selected vault and adds a key slot to it. A password
+// slot prompts for its password, a keyfile slot uses the keyfile at path,
+// and a public key slot seals the vault key to publicKey. For a recovery
+// code slot, AddSlot returns the generated code, which is not stored
+// anywhere else. The new slot has the KDF parameters of the slot that was
+// unlocked, or the default ones if that was a public key slot.
+func AddSlot(opts Options, typ Slot_Type, name, path string, publicKey []byte) (code string, _ error) {
+	dir, ss, err := lockSlots(opts)
+	if err != nil {
+		return "", err
+	}
+	var keyfile []byte
+	if typ == Slot_KEYFILE {
+		if path == "" {
+			return "", errors.New("keyfile slot needs a keyfile")
+		}
+		if keyfile, err = hashKeyfile(path); err != nil {
+			return "", err
+		}
+	}
+	if typ == Slot_PUBLIC_KEY && len(publicKey) != 32 {
+		return "", errors.New("public key slot needs a public key")
+	}
+	u, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return "", err
+	}
+
+	var secret []byte
+	switch typ {
+	case Slot_PASSWORD:
+		if secret, err = passwd.ReadNewPassword(); err != nil {
+			return "", fmt.Errorf("failed to read new password: %v", err)
+		}
+	case Slot_RECOVERY_CODE:
+		code = newRecoveryCode()
+		secret = []byte(code)
+	}
+	var id uint32
+	for _, s := range ss.Slots {
+		if s.Id > id {
+			id = s.Id
+		}
+	}
+	s := &Slot{
+		Id:         id + 1,
+		Name:       name,
+		Type:       typ,
+		CreateTime: ptypes.TimestampNow(),
+	}
+	if typ == Slot_PUBLIC_KEY {
+		s.PublicKey = publicKey
+		err = sealVaultKey(s, vaultKey)
+	} else {
+		s.Kdf = u.slot.Kdf
+		if s.Kdf == nil {
+			s.Kdf = kdfToProto(passwd.DefaultKDFParams)
+		}
+		err = sealSlot(s, secret, keyfile, vaultKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	ss.Slots = append(ss.Slots, s)
+	if err := writeSlots(dir, ss); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RemoveSlot unlocks the selected vault and removes a key slot from it. The
+// vault key is replaced and sealed to the remaining slots. The last slot
+// cannot be removed.
+func RemoveSlot(opts Options, id uint32) error {
+	dir, ss, err := lockSlots(opts)
+	if err != nil {
+		return err
+	}
+	i := -1
+	for j, s := range ss.Slots {
+		if s.Id == id {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("vault has no slot %d", id)
+	}
+	if len(ss.Slots) == 1 {
+		return errors.New("refusing to remove the last slot, which would make the vault impossible to unlock")
+	}
+	_, vaultKey, err := unlock(opts, ss)
+	if err != nil {
+		return err
+	}
+	_, kek, err := openMaster(ss, vaultKey)
+	if err != nil {
+		return err
+	}
+	ks, err := openKeyset(ss.Master, kek)
+	if err != nil {
+		return err
+	}
+	ss.Slots = append(ss.Slots[:i:i], ss.Slots[i+1:]...)
+	if err := rotateVaultKey(ss, ks); err != nil {
+		return err
+	}
+	if err := writeSlots(dir, ss); err != nil {
+		return err
+	}
+	return removeBackupKeys(dir)
+}
+
+// newRecoveryCode returns a random recovery code in groups of four letters
+// and digits.
+func newRecoveryCode() string {
+	s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(random.GetRandomBytes(recoveryCodeSize))
+	var groups []string
+	for len(s) > 4 {
+		groups = append(groups, s[:4])
+		s = s[4:]
+	}
+	return strings.Join(append(groups, s), "-")
+}
+
+// normalizeRecoveryCode lets a recovery code be typed in any case, with or
+// without separators.
+func normalizeRecoveryCode(code []byte) []byte {
+	var out []byte
+	for _, c := range bytes.ToUpper(code) {
+		if c != '-' && c != ' ' {
+			out = append(out, c)
+		}
+	}
+	return out
+}
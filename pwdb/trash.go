@@ -0,0 +1,109 @@
+package pwdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// DefaultTrashRetention is how long deleted records are kept by default.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// Trash returns the deleted records, oldest first.
+func (db *DB) Trash() []*TrashEntry {
+	return db.trash
+}
+
+// Restore moves the most recently deleted record with a name out of the
+// trash.
+func (db *DB) Restore(name string) error {
+	return db.Update(func(tx *Tx) error { return tx.Restore(name) })
+}
+
+// EmptyTrash permanently removes every deleted record.
+func (db *DB) EmptyTrash() error {
+	return db.Update(func(tx *Tx) error { return tx.EmptyTrash() })
+}
+
+// Restore moves the most recently deleted record with a name out of the
+// trash.
+func (tx *Tx) Restore(name string) error {
+	db := tx.db
+	if _, ok := db.records[name]; ok {
+		return fmt.Errorf("password %q already exists", name)
+	}
+	for i := len(db.trash) - 1; i >= 0; i-- {
+		env := db.trash[i].Envelope
+		if env.Name != name {
+			continue
+		}
+		db.trash = append(db.trash[:i:i], db.trash[i+1:]...)
+		db.trashDirty = true
+		db.putEnvelope(env)
+		return nil
+	}
+	return fmt.Errorf("password %q not found in trash", name)
+}
+
+// EmptyTrash permanently removes every deleted record.
+func (tx *Tx) EmptyTrash() error {
+	tx.db.trash = nil
+	tx.db.trashDirty = true
+	return nil
+}
+
+// TrashRetention returns how long deleted records are kept in the trash. Zero
+// means they are kept forever.
+func (db *DB) TrashRetention() time.Duration {
+	switch {
+	case db.retention == 0:
+		return DefaultTrashRetention
+	case db.retention < 0:
+		return 0
+	}
+	return db.retention
+}
+
+// SetTrashRetention sets how long deleted records are kept in the trash,
+// rounded down to a second. Zero keeps them forever. Records that are past
+// the new retention are purged by the commit.
+func (db *DB) SetTrashRetention(d time.Duration) error {
+	return db.Update(func(tx *Tx) error { return tx.SetTrashRetention(d) })
+}
+
+// SetTrashRetention sets how long deleted records are kept in the trash,
+// rounded down to a second. Zero keeps them forever.
+func (tx *Tx) SetTrashRetention(d time.Duration) error {
+	switch {
+	case d < 0:
+		return fmt.Errorf("trash retention must not be negative")
+	case d == 0:
+		d = -time.Second
+	case d < time.Second:
+		return fmt.Errorf("trash retention must be at least a second")
+	}
+	tx.db.retention = d / time.Second * time.Second
+	tx.db.retentionDirty = true
+	return nil
+}
+
+// purgeTrash drops the entries that were deleted longer than the retention
+// period ago, and reports whether there were any.
+func (db *DB) purgeTrash(now time.Time) bool {
+	retention := db.TrashRetention()
+	if retention == 0 {
+		return false
+	}
+	var keep []*TrashEntry
+	for _, e := range db.trash {
+		t, err := ptypes.Timestamp(e.DeleteTime)
+		if err == nil && now.Sub(t) > retention {
+			continue
+		}
+		keep = append(keep, e)
+	}
+	purged := len(keep) < len(db.trash)
+	db.trash = keep
+	return purged
+}
@@ -0,0 +1,179 @@
+package pwdb
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// Tx is a set of changes to a DB that are committed together by Update.
+type Tx struct {
+	db *DB
+}
+
+// Update calls fn with a transaction and commits every change fn makes with
+// a single write. If fn or the commit fails, none of the changes are kept.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	if db.readOnly {
+		return errReadOnly
+	}
+	undo := db.checkpoint()
+	if err := fn(&Tx{db: db}); err != nil {
+		undo()
+		return err
+	}
+	if err := db.commit(); err != nil {
+		// Once the log entry is written the changes are durable, even if
+		// what follows it fails.
+		if len(db.dirty) > 0 || db.trashDirty || db.retentionDirty {
+			undo()
+		}
+		return err
+	}
+	return nil
+}
+
+// checkpoint returns a func that restores the records, trash, trash retention
+// and generation to their current state. Envelopes are never modified in
+// place, so copying the map and slice is enough.
+func (db *DB) checkpoint() func() {
+	records := make(map[string]*Envelope, len(db.records))
+	for name, env := range db.records {
+		records[name] = env
+	}
+	trash := append([]*TrashEntry(nil), db.trash...)
+	dirty := make(map[string]bool, len(db.dirty))
+	for name := range db.dirty {
+		dirty[name] = true
+	}
+	trashDirty := db.trashDirty
+	retention, retentionDirty := db.retention, db.retentionDirty
+	generation := db.generation
+	return func() {
+		db.generation = generation
+		db.records = records
+		db.trash = trash
+		db.dirty = dirty
+		db.trashDirty = trashDirty
+		db.retention, db.retentionDirty = retention, retentionDirty
+	}
+}
+
+// Get returns the current revision of a record, including changes made
+// earlier in the transaction.
+func (tx *Tx) Get(name string) (*Record, error) {
+	return tx.db.Get(name)
+}
+
+// Put sets the current revision of a record. Its update time is set to now.
+// Its create time is kept from the current revision if the record exists,
+// and otherwise set to now unless r already has one.
+func (tx *Tx) Put(name string, r *Record) error {
+	db := tx.db
+	if err := checkRecord(r); err != nil {
+		return err
+	}
+	r = proto.Clone(r).(*Record)
+	now := ptypes.TimestampNow()
+	if prev, err := db.Get(name); err == nil && prev.CreateTime != nil {
+		r.CreateTime = prev.CreateTime
+	} else if r.CreateTime == nil {
+		r.CreateTime = now
+	}
+	r.UpdateTime = now
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return err
+	}
+	c, err := db.master.Encrypt(b, []byte(name))
+	if err != nil {
+		return err
+	}
+	return db.setData(name, c, r)
+}
+
+// Rollback makes revision n the current revision of a record. The current
+// revision is kept in the history, so a rollback can itself be undone.
+func (tx *Tx) Rollback(name string, n int) error {
+	db := tx.db
+	if n == 0 {
+		return nil
+	}
+	rev, err := db.revision(name, n)
+	if err != nil {
+		return err
+	}
+	// Check that the revision is intact before we make it current.
+	r, err := db.decrypt(name, rev.Data)
+	if err != nil {
+		return fmt.Errorf("revision %d of %q is unreadable: %v", n, name, err)
+	}
+	return db.setData(name, rev.Data, r)
+}
+
+// Delete moves a record and its history to the trash.
+func (tx *Tx) Delete(name string) error {
+	db := tx.db
+	env, ok := db.records[name]
+	if !ok {
+		return fmt.Errorf("password %q not found", name)
+	}
+	db.removeEnvelope(name)
+	db.trash = append(db.trash, &TrashEntry{
+		Envelope:   env,
+		DeleteTime: ptypes.TimestampNow(),
+	})
+	db.trashDirty = true
+	return nil
+}
+
+// Rename moves a record and its history to a new name. Since the name is
+// bound to the ciphertext, every revision is re-encrypted. If from is a
+// folder, every record in it is moved into the folder to.
+func (tx *Tx) Rename(from, to string) error {
+	db := tx.db
+	names := []string{from}
+	if IsFolder(from) {
+		names = db.List(from)
+		if len(names) == 0 {
+			return fmt.Errorf("folder %q is empty", from)
+		}
+		to = folderPrefix(to)
+	} else if IsFolder(to) {
+		to += path.Base(from)
+	}
+	envs := make(map[string]*Envelope)
+	for _, name := range names {
+		newName := to
+		if IsFolder(from) {
+			newName = to + strings.TrimPrefix(name, from)
+		}
+		env, err := db.reseal(name, newName)
+		if err != nil {
+			return err
+		}
+		envs[name] = env
+	}
+	for name, env := range envs {
+		db.removeEnvelope(name)
+		db.putEnvelope(env)
+	}
+	return nil
+}
+
+// Duplicate copies the current revision of a record to a new name.
+func (tx *Tx) Duplicate(from, to string) error {
+	db := tx.db
+	r, err := db.Get(from)
+	if err != nil {
+		return err
+	}
+	if _, ok := db.records[to]; ok {
+		return fmt.Errorf("password %q already exists", to)
+	}
+	r.CreateTime = nil
+	return tx.Put(to, r)
+}
@@ -0,0 +1,212 @@
+package pwdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultVault is the vault stored directly in the root directory. It is
+// where every vault lived before named vaults existed.
+const DefaultVault = "default"
+
+// Options configure which vault Open loads.
+type Options struct {
+	// Dir is the root directory that holds all vaults. If empty, $PWSTORE_DIR
+	// is used, then ~/.pwstore.
+	Dir string
+	// Vault is the name of the vault to open. If empty, the vault selected
+	// with UseVault is used, then DefaultVault.
+	Vault string
+	// ReadOnly opens the vault with a shared lock so that it can be read by
+	// several processes at once. Writes to a read-only DB fail.
+	ReadOnly bool
+	// LockTimeout is how long to wait for a lock held by another process.
+	LockTimeout time.Duration
+	// CompactThreshold is the size in bytes of pw.log above which a commit
+	// compacts it. If zero, DefaultCompactThreshold is used.
+	CompactThreshold int64
+	// ForceAcceptRollback opens a vault even if it is older than the last
+	// version committed to it, e.g. after restoring pw.db from a backup.
+	ForceAcceptRollback bool
+	// Backups is the number of automatic backups to keep. If zero,
+	// DefaultBackups is used. If negative, no backups are made.
+	Backups int
+	// StateDir is the directory that holds per-user state kept outside of
+	// the vaults, such as the last generation committed to each. If empty,
+	// $PWSTORE_STATE_DIR is used, then $XDG_STATE_HOME/pwstore, then
+	// ~/.local/state/pwstore.
+	StateDir string
+	// Keyfile is the path of the keyfile of a vault that needs one. If
+	// empty, $PWSTORE_KEYFILE is used, then the path recorded by SetKeyfile.
+	// A new vault needs the keyfile if one is given.
+	Keyfile string
+	// Identity is the path of an identity file that opens a public key slot
+	// of a vault. If empty, $PWSTORE_IDENTITY is used.
+	Identity string
+	// Command names the command that opens the vault, such as "slots add",
+	// in the lock file of the vault for anyone waiting on it. It must not
+	// hold arguments, which may name records.
+	Command string
+}
+
+func (o Options) root() (string, error) {
+	if o.Dir != "" {
+		return o.Dir, nil
+	}
+	if dir := os.Getenv("PWSTORE_DIR"); dir != "" {
+		return dir, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find user home dir: %v", err)
+	}
+	return filepath.Join(homeDir, ".pwstore"), nil
+}
+
+func (o Options) stateDir() (string, error) {
+	if o.StateDir != "" {
+		return o.StateDir, nil
+	}
+	if dir := os.Getenv("PWSTORE_STATE_DIR"); dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "pwstore"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find user home dir: %v", err)
+	}
+	return filepath.Join(homeDir, ".local", "state", "pwstore"), nil
+}
+
+// generationFile returns the path of the state file that records the last
+// generation committed to the vault in dir.
+func (o Options) generationFile(dir string) (string, error) {
+	root, err := o.stateDir()
+	if err != nil {
+		return "", err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(root, "generations", hex.EncodeToString(sum[:16])), nil
+}
+
+func (o Options) vault() (string, error) {
+	if o.Vault != "" {
+		return o.Vault, nil
+	}
+	return CurrentVault(o)
+}
+
+// Path returns the directory of the selected vault.
+func (o Options) Path() (string, error) {
+	root, err := o.root()
+	if err != nil {
+		return "", err
+	}
+	name, err := o.vault()
+	if err != nil {
+		return "", err
+	}
+	return vaultDir(root, name)
+}
+
+func vaultDir(root, name string) (string, error) {
+	if err := validVaultName(name); err != nil {
+		return "", err
+	}
+	if name == DefaultVault {
+		return root, nil
+	}
+	return filepath.Join(root, "vaults", name), nil
+}
+
+func validVaultName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return fmt.Errorf("invalid vault name %q", name)
+	}
+	return nil
+}
+
+// CurrentVault returns the name of the vault selected with UseVault.
+func CurrentVault(o Options) (string, error) {
+	root, err := o.root()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "current"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultVault, nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// UseVault selects the vault that Open loads when Options.Vault is empty.
+func UseVault(o Options, name string) error {
+	root, err := o.root()
+	if err != nil {
+		return err
+	}
+	dir, err := vaultDir(root, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("vault %q does not exist", name)
+		}
+		return err
+	}
+	return writeFile(filepath.Join(root, "current"), []byte(name+"\n"))
+}
+
+// CreateVault creates an empty vault. Its keys are generated the first time
+// it is opened.
+func CreateVault(o Options, name string) error {
+	root, err := o.root()
+	if err != nil {
+		return err
+	}
+	dir, err := vaultDir(root, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("vault %q already exists", name)
+	}
+	return os.MkdirAll(dir, 0700)
+}
+
+// ListVaults returns the names of all vaults under the root directory.
+func ListVaults(o Options) ([]string, error) {
+	root, err := o.root()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{DefaultVault}
+	fis, err := ioutil.ReadDir(filepath.Join(root, "vaults"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() && fi.Name() != DefaultVault {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type rmCmd struct {
+	yes bool
+}
+
+func (c *rmCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "rm <name|glob>...",
+		Args: cobra.MinimumNArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *rmCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.BoolVarP(&c.yes, "yes", "y", false, "")
+}
+
+func (c *rmCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	names, err := matchAll(db, args)
+	if err != nil {
+		cmd.PrintErrf("failed to match records: %v", err)
+		return
+	}
+	if len(names) > 1 && !c.yes {
+		for _, name := range names {
+			cmd.Println(name)
+		}
+		if !confirm(cmd, "Delete %d records?", len(names)) {
+			return
+		}
+	}
+	err = db.Update(func(tx *pwdb.Tx) error {
+		for _, name := range names {
+			if err := tx.Delete(name); err != nil {
+				return fmt.Errorf("%q: %v", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to delete records: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+// matchAll expands every pattern to the records it matches. It fails if a
+// pattern matches nothing.
+func matchAll(db *pwdb.DB, patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	for _, p := range patterns {
+		names, err := db.Match(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no records match %q", p)
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				out = append(out, name)
+			}
+		}
+	}
+	return out, nil
+}
+
+// confirm asks a yes/no question on stdin and defaults to no.
+func confirm(cmd *cobra.Command, format string, args ...interface{}) bool {
+	cmd.Printf(format+" [y/N] ", args...)
+	line, _ := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+type mvCmd struct {
+}
+
+func (c *mvCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "mv <from> <to>",
+		Args: cobra.ExactArgs(2),
+		Run:  c.run,
+	}
+}
+
+func (c *mvCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *mvCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if err := db.Rename(args[0], args[1]); err != nil {
+		cmd.PrintErrf("failed to rename %q: %v", args[0], err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type cpCmd struct {
+}
+
+func (c *cpCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "cp <from> <to>",
+		Args: cobra.ExactArgs(2),
+		Run:  c.run,
+	}
+}
+
+func (c *cpCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *cpCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if err := db.Duplicate(args[0], args[1]); err != nil {
+		cmd.PrintErrf("failed to copy %q: %v", args[0], err)
+		return
+	}
+	cmd.Println("ok")
+}
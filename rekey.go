@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type rekeyCmd struct {
+}
+
+func (c *rekeyCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rekey",
+		Short: "Rotates the master key of the vault and re-encrypts every record under the new key.",
+		Long: `Rotates the master key of the vault and re-encrypts every record under the new key.
+
+The old key is disabled and then destroyed once the vault has been read back
+without it. An interrupted rekey is resumed by running rekey again. Every
+backup is removed before the old key is destroyed, since backups cannot be
+read without it, so there are no backups after a rekey until the next write.`,
+		Run: c.run,
+	}
+}
+
+func (c *rekeyCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *rekeyCmd) run(cmd *cobra.Command, args []string) {
+	last := -1
+	progress := func(done, total int) {
+		pct := 100
+		if total > 0 {
+			pct = done * 100 / total
+		}
+		if pct != last {
+			cmd.PrintErrf("\rre-encrypting: %d/%d (%d%%)", done, total, pct)
+			last = pct
+		}
+	}
+	err := pwdb.Rekey(opts, progress)
+	if last >= 0 {
+		cmd.PrintErrln()
+	}
+	if err != nil {
+		cmd.PrintErrf("failed to rekey vault: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type searchCmd struct {
+	regex  bool
+	format string
+}
+
+func (c *searchCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "search <query>...",
+		Short: "Search records by name, user, url, tag, type, note or field, e.g. user:alice tag:prod.",
+		Long: `Search records by name, user, url, tag, type, note or field, e.g. user:alice tag:prod.
+
+A bare pattern matches the name, user, urls, tags or type of a record, which
+are searched without decrypting any record. Notes and custom fields are only
+searched by note: and field: terms, which decrypt every record they check.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *searchCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.BoolVarP(&c.regex, "regex", "E", false, "treat patterns as regular expressions")
+	fs.StringVar(&c.format, "format", "table", "table or json")
+}
+
+// searchResult is a record found by search. It leaves out every secret.
+type searchResult struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Username string   `json:"username,omitempty"`
+	URLs     []string `json:"urls,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func (c *searchCmd) run(cmd *cobra.Command, args []string) {
+	if c.format != "table" && c.format != "json" {
+		cmd.PrintErrf("unknown format %q", c.format)
+		return
+	}
+	q, err := pwdb.ParseQuery(strings.Join(args, " "), c.regex)
+	if err != nil {
+		cmd.PrintErrf("failed to parse query: %v", err)
+		return
+	}
+	db, err := pwdb.Open(readOnly())
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	results := []searchResult{}
+	for _, name := range db.List("") {
+		m, err := db.Metadata(name)
+		if err != nil {
+			cmd.PrintErrf("failed to get %q: %v", name, err)
+			return
+		}
+		ok, err := q.Match(name, m, func() (*pwdb.Record, error) { return db.Get(name) })
+		if err != nil {
+			cmd.PrintErrf("failed to get %q: %v", name, err)
+			return
+		}
+		if !ok {
+			continue
+		}
+		results = append(results, searchResult{
+			Name:     name,
+			Type:     m.Kind,
+			Username: m.Username,
+			URLs:     m.Urls,
+			Tags:     m.Tags,
+		})
+	}
+
+	out := cmd.OutOrStdout()
+	if c.format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			cmd.PrintErrf("failed to write results: %v", err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	w.Write([]byte("NAME\tTYPE\tUSERNAME\tURLS\tTAGS\n"))
+	for _, r := range results {
+		w.Write([]byte(strings.Join([]string{
+			r.Name, r.Type, r.Username, strings.Join(r.URLs, ","), strings.Join(r.Tags, ","),
+		}, "\t") + "\n"))
+	}
+	w.Flush()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type slotsListCmd struct {
+}
+
+func (c *slotsListCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Lists the key slots of the vault.",
+		Args:  cobra.NoArgs,
+		Run:   c.run,
+	}
+}
+
+func (c *slotsListCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *slotsListCmd) run(cmd *cobra.Command, args []string) {
+	slots, err := pwdb.Slots(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to list slots: %v", err)
+		return
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+	w.Write([]byte("ID\tTYPE\tNAME\tKDF\tKEYFILE\tCREATED\n"))
+	for _, s := range slots {
+		kdf := "?"
+		if s.Type == pwdb.Slot_PUBLIC_KEY {
+			kdf = "-"
+		} else if p, err := s.KDFParams(); err == nil {
+			kdf = formatKDF(p)
+		}
+		keyfile := "no"
+		if len(s.KeyfileCheck) > 0 {
+			keyfile = "yes"
+		}
+		created := ""
+		if t, err := ptypes.Timestamp(s.CreateTime); err == nil {
+			created = formatTime(t)
+		}
+		w.Write([]byte(strings.Join([]string{
+			strconv.Itoa(int(s.Id)), slotTypeName(s.Type), s.Name, kdf, keyfile, created,
+		}, "\t") + "\n"))
+	}
+	w.Flush()
+}
+
+func slotTypeName(t pwdb.Slot_Type) string {
+	for name, typ := range pwdb.SlotTypes {
+		if typ == t {
+			return name
+		}
+	}
+	return t.String()
+}
+
+type slotsAddCmd struct {
+	typ       string
+	name      string
+	keyfile   string
+	publicKey string
+}
+
+func (c *slotsAddCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "add",
+		Short: "Adds a password, recovery code, keyfile or public key slot that also unlocks the vault.",
+		Args:  cobra.NoArgs,
+		Run:   c.run,
+	}
+}
+
+func (c *slotsAddCmd) bindFlags(fs *pflag.FlagSet) {
+	var types []string
+	for name := range pwdb.SlotTypes {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	fs.StringVar(&c.typ, "type", "password", "one of "+strings.Join(types, ", "))
+	fs.StringVar(&c.name, "name", "", "name of the slot, e.g. who it is for, defaults to the type")
+	fs.StringVar(&c.keyfile, "keyfile-path", "", "keyfile that opens a keyfile slot")
+	fs.StringVar(&c.publicKey, "public-key", "", "public key of the identity that opens a public key slot, as identity create prints it")
+}
+
+func (c *slotsAddCmd) run(cmd *cobra.Command, args []string) {
+	typ, ok := pwdb.SlotTypes[c.typ]
+	if !ok {
+		cmd.PrintErrf("unknown slot type %q", c.typ)
+		return
+	}
+	if c.keyfile != "" && typ != pwdb.Slot_KEYFILE {
+		cmd.PrintErrf("--keyfile-path is only for keyfile slots")
+		return
+	}
+	if (c.publicKey != "") != (typ == pwdb.Slot_PUBLIC_KEY) {
+		cmd.PrintErrf("--public-key is needed for public key slots, and only for them")
+		return
+	}
+	var publicKey []byte
+	if c.publicKey != "" {
+		var err error
+		if publicKey, err = pwdb.ParsePublicKey(c.publicKey); err != nil {
+			cmd.PrintErrf("%v", err)
+			return
+		}
+	}
+	name := c.name
+	if name == "" {
+		name = c.typ
+	}
+	code, err := pwdb.AddSlot(opts, typ, name, c.keyfile, publicKey)
+	if err != nil {
+		cmd.PrintErrf("failed to add slot: %v", err)
+		return
+	}
+	if code != "" {
+		fmt.Fprintf(cmd.OutOrStdout(), "recovery code: %s\n", code)
+		fmt.Fprintln(cmd.OutOrStdout(), "store it somewhere safe; it is not shown again")
+		return
+	}
+	cmd.Println("ok")
+}
+
+type slotsRemoveCmd struct {
+}
+
+func (c *slotsRemoveCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <id>",
+		Short: "Removes a key slot and replaces the vault key of the others, after unlocking the vault with any slot.",
+		Args:  cobra.ExactArgs(1),
+		Run:   c.run,
+	}
+}
+
+func (c *slotsRemoveCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *slotsRemoveCmd) run(cmd *cobra.Command, args []string) {
+	id, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		cmd.PrintErrf("invalid slot id %q", args[0])
+		return
+	}
+	if err := pwdb.RemoveSlot(opts, uint32(id)); err != nil {
+		cmd.PrintErrf("failed to remove slot: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
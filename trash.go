@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type trashListCmd struct {
+}
+
+func (c *trashListCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "list",
+		Run: c.run,
+	}
+}
+
+func (c *trashListCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *trashListCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(readOnly())
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	for _, e := range db.Trash() {
+		t, _ := ptypes.Timestamp(e.DeleteTime)
+		cmd.Printf("%s\t%s\n", formatTime(t), e.Envelope.Name)
+	}
+}
+
+type trashRestoreCmd struct {
+}
+
+func (c *trashRestoreCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "restore <name>...",
+		Args: cobra.MinimumNArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *trashRestoreCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *trashRestoreCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	err = db.Update(func(tx *pwdb.Tx) error {
+		for _, name := range args {
+			if err := tx.Restore(name); err != nil {
+				return fmt.Errorf("%q: %v", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cmd.PrintErrf("failed to restore records: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type trashEmptyCmd struct {
+	yes bool
+}
+
+func (c *trashEmptyCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "empty",
+		Run: c.run,
+	}
+}
+
+func (c *trashEmptyCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.BoolVarP(&c.yes, "yes", "y", false, "")
+}
+
+func (c *trashEmptyCmd) run(cmd *cobra.Command, args []string) {
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if n := len(db.Trash()); n > 0 && !c.yes {
+		if !confirm(cmd, "Permanently delete %d records?", n) {
+			return
+		}
+	}
+	if err := db.EmptyTrash(); err != nil {
+		cmd.PrintErrf("failed to empty trash: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type trashRetentionCmd struct {
+}
+
+func (c *trashRetentionCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "retention [duration]",
+		Short: "Shows or sets how long deleted records are kept, e.g. 720h. 0 keeps them forever.",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   c.run,
+	}
+}
+
+func (c *trashRetentionCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *trashRetentionCmd) run(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		db, err := pwdb.Open(readOnly())
+		if err != nil {
+			cmd.PrintErrf("failed to open pwdb: %v", err)
+			return
+		}
+		if d := db.TrashRetention(); d == 0 {
+			cmd.Println("forever")
+		} else {
+			cmd.Println(d)
+		}
+		return
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		cmd.PrintErrf("invalid retention %q: %v", args[0], err)
+		return
+	}
+	db, err := pwdb.Open(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to open pwdb: %v", err)
+		return
+	}
+	if err := db.SetTrashRetention(d); err != nil {
+		cmd.PrintErrf("failed to set trash retention: %v", err)
+		return
+	}
+	cmd.Println("ok")
+}
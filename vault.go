@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/mikedanese/pwstore/pwdb"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type vaultListCmd struct {
+}
+
+func (c *vaultListCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use: "list",
+		Run: c.run,
+	}
+}
+
+func (c *vaultListCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *vaultListCmd) run(cmd *cobra.Command, args []string) {
+	names, err := pwdb.ListVaults(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to list vaults: %v", err)
+		return
+	}
+	current, err := pwdb.CurrentVault(opts)
+	if err != nil {
+		cmd.PrintErrf("failed to read current vault: %v", err)
+		return
+	}
+	for _, name := range names {
+		if name == current {
+			cmd.Println("*", name)
+		} else {
+			cmd.Println(" ", name)
+		}
+	}
+}
+
+type vaultUseCmd struct {
+}
+
+func (c *vaultUseCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "use <name>",
+		Args: cobra.ExactArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *vaultUseCmd) bindFlags(fs *pflag.FlagSet) {
+}
+
+func (c *vaultUseCmd) run(cmd *cobra.Command, args []string) {
+	if err := pwdb.UseVault(opts, args[0]); err != nil {
+		cmd.PrintErrf("failed to use vault %q: %v", args[0], err)
+		return
+	}
+	cmd.Println("ok")
+}
+
+type vaultCreateCmd struct {
+	use          bool
+	encryptNames bool
+}
+
+func (c *vaultCreateCmd) cmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "create <name>",
+		Args: cobra.ExactArgs(1),
+		Run:  c.run,
+	}
+}
+
+func (c *vaultCreateCmd) bindFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&c.use, "use", false, "")
+	fs.BoolVar(&c.encryptNames, "encrypt-names", false, "")
+}
+
+func (c *vaultCreateCmd) run(cmd *cobra.Command, args []string) {
+	name := args[0]
+	if err := pwdb.CreateVault(opts, name); err != nil {
+		cmd.PrintErrf("failed to create vault %q: %v", name, err)
+		return
+	}
+	o := opts
+	o.Vault = name
+	// Opening the new vault generates its salt and master keyset.
+	db, err := pwdb.Open(o)
+	if err != nil {
+		cmd.PrintErrf("failed to initialize vault %q: %v", name, err)
+		return
+	}
+	if c.encryptNames {
+		if err := db.EncryptNames(); err != nil {
+			cmd.PrintErrf("failed to encrypt names: %v", err)
+			return
+		}
+	}
+	if c.use {
+		if err := pwdb.UseVault(opts, name); err != nil {
+			cmd.PrintErrf("failed to use vault %q: %v", name, err)
+			return
+		}
+	}
+	cmd.Println("ok")
+}